@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	authMethodName     = "VAULT_AUTH_METHOD"
+	authPathName       = "VAULT_AUTH_PATH"
+	authRoleName       = "VAULT_ROLE"
+	kubernetesJWT      = "VAULT_SERVICE_ACCOUNT_JWT"
+	kubernetesAuthType = "kubernetes"
+)
+
+// authMethod is a way of logging in to Vault. Every method posts a JSON
+// payload to `auth/<mount>/login` and gets a token back; they only differ in
+// what goes into the payload.
+type authMethod interface {
+	// name is the auth method type, as passed in VAULT_AUTH_METHOD.
+	name() string
+	// role is the role logged in with, used for logging only.
+	role() string
+	loginPath() string
+	// payload builds the body of the login request. It is called right
+	// before logging in, so credentials read from files are current.
+	payload(vc VaultClient) (map[string]string, error)
+}
+
+// newAuthMethod returns the auth method selected with VAULT_AUTH_METHOD.
+func newAuthMethod() authMethod {
+	method := GetenvSafe(authMethodName, false)
+	switch method {
+	case "", kubernetesAuthType:
+		return newKubernetesAuth()
+	case appRoleAuthType:
+		return newAppRoleAuth()
+	case jwtAuthType:
+		return newJWTAuth()
+	case awsAuthType:
+		return newAWSAuth()
+	case gcpAuthType:
+		return newGCPAuth()
+	case azureAuthType:
+		return newAzureAuth()
+	case certAuthType:
+		return newCertAuth()
+	default:
+		log.Fatalf("ERROR: unsupported %s '%s'", authMethodName, method)
+	}
+	return nil
+}
+
+// kubernetesAuth logs in with a Kubernetes service account token. Without
+// configuration it follows the naming `bootstrap-gke.sh` sets up: the
+// `kubernetes-<cluster>` mount, the `<namespace>-vault-sa` role and a token
+// passed in VAULT_SERVICE_ACCOUNT_JWT.
+type kubernetesAuth struct {
+	mountPath string
+	roleName  string
+	jwt       credentialSource
+}
+
+func newKubernetesAuth() kubernetesAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = fmt.Sprintf("kubernetes-%s", GetenvSafe("KUBERNETES_CLUSTER", true))
+	}
+
+	role := GetenvSafe(authRoleName, false)
+	if role == "" {
+		role = namespaceRole(GetNamespace())
+		log.Printf("INFO: using Kubernetes auth role %s, derived from the pod's namespace; set %s to use another one", role, authRoleName)
+	} else {
+		log.Printf("INFO: using Kubernetes auth role %s from %s", role, authRoleName)
+		warnRoleChanged(role)
+	}
+
+	return kubernetesAuth{mountPath: mountPath, roleName: role, jwt: newCredentialSource(kubernetesJWT, true)}
+}
+
+// namespaceRole returns the role `bootstrap-gke.sh` creates for namespace.
+func namespaceRole(namespace string) string {
+	return fmt.Sprintf("%s-vault-sa", namespace)
+}
+
+// warnRoleChanged warns when VAULT_ROLE names a role other than the one
+// derived from the namespace. Before VAULT_ROLE was honoured, that role was
+// always used, so a manifest that set VAULT_ROLE to something unrelated now
+// logs in with a different role.
+func warnRoleChanged(role string) {
+	content, err := ioutil.ReadFile(namespacePath)
+	if err != nil {
+		return
+	}
+	namespace := strings.TrimSpace(string(content))
+	if namespace == "" || namespaceRole(namespace) == role {
+		return
+	}
+	log.Printf("WARN: %s=%s is used instead of %s; versions that ignored %s logged in with %s, unset %s to keep doing so", authRoleName, role, namespaceRole(namespace), authRoleName, namespaceRole(namespace), authRoleName)
+}
+
+func (a kubernetesAuth) name() string {
+	return kubernetesAuthType
+}
+
+func (a kubernetesAuth) role() string {
+	return a.roleName
+}
+
+func (a kubernetesAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+func (a kubernetesAuth) payload(vc VaultClient) (map[string]string, error) {
+	jwt, err := a.jwt.load()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"jwt": jwt, "role": a.roleName}, nil
+}
+
+// authMountPath normalises a configured auth mount path, so `kubernetes`,
+// `/kubernetes/` and `auth/kubernetes` all refer to the same mount.
+func authMountPath(path string) string {
+	return strings.TrimPrefix(strings.Trim(path, "/"), "auth/")
+}
+
+// credentialSource is a credential passed either directly in an environment
+// variable or as a file named by the same variable with a `_FILE` suffix,
+// like VAULT_SERVICE_ACCOUNT_JWT and VAULT_SERVICE_ACCOUNT_JWT_FILE. Files
+// are read on every load so credentials rotated on disk are picked up.
+type credentialSource struct {
+	name  string
+	value string
+	file  string
+}
+
+func newCredentialSource(name string, strict bool) credentialSource {
+	source := credentialSource{name: name, file: GetenvSafe(name+"_FILE", false)}
+	if source.file == "" {
+		source.value = GetenvSafe(name, strict)
+	}
+	return source
+}
+
+func (s credentialSource) isSet() bool {
+	return s.value != "" || s.file != ""
+}
+
+func (s credentialSource) load() (string, error) {
+	if s.file == "" {
+		return s.value, nil
+	}
+	return readCredentialFile(s.file)
+}
+
+// readCredentialFile reads a token or similar credential from path, without
+// surrounding whitespace.
+func readCredentialFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read credential file %s: %s", path, err.Error())
+	}
+
+	credential := strings.TrimSpace(string(content))
+	if len(credential) == 0 {
+		return "", errors.New(fmt.Sprintf("credential file %s is empty", path))
+	}
+	return credential, nil
+}
+
+// getenvBool reports whether key is set to a true value.
+func getenvBool(key string) bool {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "true", "1", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	appRoleAuthType      = "approle"
+	appRoleRoleID        = "VAULT_ROLE_ID"
+	appRoleSecretID      = "VAULT_SECRET_ID"
+	appRoleSecretWrapped = "VAULT_SECRET_ID_WRAPPED"
+	unwrapPath           = "sys/wrapping/unwrap"
+)
+
+// appRoleAuth logs in with an AppRole role_id and secret_id. The secret_id
+// may be handed over response-wrapped, in which case the wrapping token is
+// unwrapped right before the first login.
+type appRoleAuth struct {
+	mountPath string
+	roleID    credentialSource
+	secretID  credentialSource
+	wrapped   bool
+	unwrapped *unwrappedSecretID
+}
+
+// unwrappedSecretID keeps the secret_id a wrapping token held, since the
+// token can only be unwrapped once and the fetcher logs in again when its
+// token reaches its max TTL in supervisor mode.
+type unwrappedSecretID struct {
+	sync.Mutex
+	wrappingToken string
+	secretID      string
+}
+
+func newAppRoleAuth() appRoleAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = appRoleAuthType
+	}
+
+	auth := appRoleAuth{
+		mountPath: mountPath,
+		roleID:    newCredentialSource(appRoleRoleID, true),
+		// Roles created with bind_secret_id=false don't need a secret_id.
+		secretID:  newCredentialSource(appRoleSecretID, false),
+		wrapped:   getenvBool(appRoleSecretWrapped),
+		unwrapped: &unwrappedSecretID{},
+	}
+	if auth.wrapped && !auth.secretID.isSet() {
+		log.Fatalf("ERROR: %s is set but no %s or %s_FILE was provided", appRoleSecretWrapped, appRoleSecretID, appRoleSecretID)
+	}
+	return auth
+}
+
+func (a appRoleAuth) name() string {
+	return appRoleAuthType
+}
+
+func (a appRoleAuth) role() string {
+	return ""
+}
+
+func (a appRoleAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+func (a appRoleAuth) payload(vc VaultClient) (map[string]string, error) {
+	roleID, err := a.roleID.load()
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]string{"role_id": roleID}
+
+	if !a.secretID.isSet() {
+		return payload, nil
+	}
+	secretID, err := a.secretID.load()
+	if err != nil {
+		return nil, err
+	}
+	if a.wrapped {
+		if secretID, err = a.unwrapOnce(vc, secretID); err != nil {
+			return nil, err
+		}
+	}
+	payload["secret_id"] = secretID
+	return payload, nil
+}
+
+// unwrapOnce returns the secret_id wrapped by wrappingToken, unwrapping it
+// unless it already was. A new wrapping token, such as one written to
+// VAULT_SECRET_ID_FILE since, is unwrapped in turn.
+func (a appRoleAuth) unwrapOnce(vc VaultClient, wrappingToken string) (string, error) {
+	a.unwrapped.Lock()
+	defer a.unwrapped.Unlock()
+	if a.unwrapped.secretID != "" && a.unwrapped.wrappingToken == wrappingToken {
+		return a.unwrapped.secretID, nil
+	}
+
+	secretID, err := a.unwrapSecretID(vc, wrappingToken)
+	if err != nil {
+		return "", err
+	}
+	a.unwrapped.wrappingToken, a.unwrapped.secretID = wrappingToken, secretID
+	return secretID, nil
+}
+
+type unwrapResponse struct {
+	Data struct {
+		SecretID string `json:"secret_id"`
+	} `json:"data"`
+}
+
+// unwrapSecretID exchanges a wrapping token for the secret_id it wraps. A
+// wrapping token can only be unwrapped once, so a failure here usually means
+// someone else already used it. For the same reason the request is sent to
+// the current node with a single attempt: resending it, even to another node
+// after an error, would fail against a token the first attempt consumed.
+func (a appRoleAuth) unwrapSecretID(vc VaultClient, wrappingToken string) (string, error) {
+	once := vc
+	once.client = vc.client.withoutRetries()
+
+	req := vc.newRequest("POST", unwrapPath, nil)
+	req.Header.Set("X-Vault-Token", wrappingToken)
+	req.URL = nodeURL(vc.nodes.address(), req.URL)
+
+	status, body, err := once.send(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap secret_id: %s", err.Error())
+	}
+	if status != 200 {
+		return "", fmt.Errorf("failed to unwrap secret_id - Response code: %d - %s", status, body)
+	}
+
+	var resp unwrapResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("failed to unmarshal unwrap response: %s", err.Error())
+	}
+	if resp.Data.SecretID == "" {
+		return "", fmt.Errorf("unwrapped response contains no secret_id")
+	}
+	return resp.Data.SecretID, nil
+}
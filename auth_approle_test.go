@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAppRoleVault unwraps each wrapping token it holds once, as Vault does,
+// and logs in role_id `role-1` with the secret_id they wrap.
+type fakeAppRoleVault struct {
+	sync.Mutex
+	wrapped  map[string]string
+	unwraps  int
+	logins   []map[string]string
+	failWith int
+}
+
+func (f *fakeAppRoleVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch r.URL.Path {
+	case "/v1/" + unwrapPath:
+		f.unwraps++
+		if f.failWith != 0 {
+			w.WriteHeader(f.failWith)
+			return
+		}
+		secretID, ok := f.wrapped[r.Header.Get("X-Vault-Token")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":["wrapping token is not valid or does not exist"]}`)
+			return
+		}
+		delete(f.wrapped, r.Header.Get("X-Vault-Token"))
+		fmt.Fprintf(w, `{"data":{"secret_id":"%s","secret_id_accessor":"a1"}}`, secretID)
+	case "/v1/auth/approle/login":
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.logins = append(f.logins, payload)
+		if payload["role_id"] != "role-1" || payload["secret_id"] != "secret-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":["invalid role or secret ID"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"auth":{"client_token":"t1","renewable":true,"lease_duration":3600}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestAppRoleAuth(secretID string, wrapped bool) appRoleAuth {
+	return appRoleAuth{
+		mountPath: appRoleAuthType,
+		roleID:    credentialSource{name: appRoleRoleID, value: "role-1"},
+		secretID:  credentialSource{name: appRoleSecretID, value: secretID},
+		wrapped:   wrapped,
+		unwrapped: &unwrappedSecretID{},
+	}
+}
+
+func TestAppRoleLogin(t *testing.T) {
+	vault := &fakeAppRoleVault{wrapped: map[string]string{"wrap-1": "secret-1"}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	vc := newTestVaultClient(server)
+	auth := newTestAppRoleAuth("wrap-1", true)
+
+	// Logging in again, as in supervisor mode, reuses the unwrapped
+	// secret_id rather than the spent wrapping token.
+	for i := 0; i < 2; i++ {
+		lease, err := vc.login(auth)
+		if err != nil {
+			t.Fatalf("login() #%d error = %v", i+1, err)
+		}
+		if lease.Duration.Seconds() != 3600 || !lease.Renewable {
+			t.Errorf("login() #%d lease = %+v", i+1, lease)
+		}
+	}
+
+	if vault.unwraps != 1 {
+		t.Errorf("wrapping token was unwrapped %d times, want once", vault.unwraps)
+	}
+	if len(vault.logins) != 2 {
+		t.Fatalf("got %d login(s), want 2", len(vault.logins))
+	}
+	if got := vc.token.get(); got != "t1" {
+		t.Errorf("token = %q, want t1", got)
+	}
+}
+
+func TestAppRoleLoginUnwrapFails(t *testing.T) {
+	tests := []struct {
+		name     string
+		secretID string
+		failWith int
+		wantErr  string
+	}{
+		{
+			name:     "wrapping token already used",
+			secretID: "used",
+			wantErr:  "failed to unwrap secret_id - Response code: 400",
+		},
+		{
+			name:     "server error",
+			secretID: "wrap-1",
+			failWith: http.StatusServiceUnavailable,
+			wantErr:  "failed to unwrap secret_id - Response code: 503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := &fakeAppRoleVault{wrapped: map[string]string{"wrap-1": "secret-1"}, failWith: tt.failWith}
+			server := httptest.NewServer(vault)
+			defer server.Close()
+			vc := newTestVaultClient(server)
+			vc.client = newRetryClient(http.DefaultClient, testRetryPolicy())
+
+			_, err := vc.login(newTestAppRoleAuth(tt.secretID, true))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("login() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			// Any retry would hit a token the first attempt may have spent.
+			if vault.unwraps != 1 {
+				t.Errorf("unwrap was attempted %d times, want once", vault.unwraps)
+			}
+			if len(vault.logins) != 0 {
+				t.Errorf("logged in without a secret_id")
+			}
+		})
+	}
+}
+
+func TestAppRoleLoginUnwrapped(t *testing.T) {
+	vault := &fakeAppRoleVault{}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	vc := newTestVaultClient(server)
+
+	if _, err := vc.login(newTestAppRoleAuth("secret-1", false)); err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	if vault.unwraps != 0 {
+		t.Errorf("a plain secret_id was unwrapped")
+	}
+	if len(vault.logins) != 1 || vault.logins[0]["secret_id"] != "secret-1" {
+		t.Errorf("logins = %v, want one with secret_id secret-1", vault.logins)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	awsAuthType          = "aws"
+	awsIAMServerIDName   = "VAULT_AWS_IAM_SERVER_ID"
+	awsIAMServerIDHeader = "X-Vault-AWS-IAM-Server-ID"
+	awsRegionName        = "VAULT_AWS_REGION"
+	stsRequestBody       = "Action=GetCallerIdentity&Version=2011-06-15"
+)
+
+// awsAuth logs in with the IAM identity of the workload. It signs an
+// sts:GetCallerIdentity request that Vault replays against STS to learn who
+// is logging in; the credentials themselves never leave the workload.
+type awsAuth struct {
+	mountPath string
+	roleName  string
+	serverID  string
+	region    string
+}
+
+func newAWSAuth() awsAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = awsAuthType
+	}
+
+	return awsAuth{
+		mountPath: mountPath,
+		// Vault uses the role named after the IAM principal when no role is
+		// given.
+		roleName: GetenvSafe(authRoleName, false),
+		serverID: GetenvSafe(awsIAMServerIDName, false),
+		region:   GetenvSafe(awsRegionName, false),
+	}
+}
+
+func (a awsAuth) name() string {
+	return awsAuthType
+}
+
+func (a awsAuth) role() string {
+	return a.roleName
+}
+
+func (a awsAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+// stsEndpoint returns the STS endpoint and the region to sign for. Without a
+// region the global endpoint is used, which is what Vault expects unless its
+// sts_endpoint is configured otherwise.
+func (a awsAuth) stsEndpoint() (string, string) {
+	if a.region == "" {
+		return "https://sts.amazonaws.com/", defaultAWSRegion
+	}
+	return fmt.Sprintf("https://sts.%s.amazonaws.com/", a.region), a.region
+}
+
+func (a awsAuth) payload(vc VaultClient) (map[string]string, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, region := a.stsEndpoint()
+	body := []byte(stsRequestBody)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if a.serverID != "" {
+		req.Header.Set(awsIAMServerIDHeader, a.serverID)
+	}
+	signAWSRequest(req, body, creds, region, "sts", time.Now())
+
+	headers, err := json.Marshal(req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]string{
+		"iam_http_request_method": req.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(endpoint)),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+	}
+	if a.roleName != "" {
+		payload["role"] = a.roleName
+	}
+	return payload, nil
+}
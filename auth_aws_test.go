@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAWSAuthPayload(t *testing.T) {
+	imds := fakeIMDS(false, "app-role")
+	defer imds.Close()
+	withoutAWSCredentials(t)
+	setenv(t, "AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+
+	tests := []struct {
+		name          string
+		auth          awsAuth
+		wantURL       string
+		wantScope     string
+		wantSigned    string
+		wantServerID  string
+		wantRoleField string
+	}{
+		{
+			name:       "global endpoint",
+			auth:       awsAuth{mountPath: "aws"},
+			wantURL:    "https://sts.amazonaws.com/",
+			wantScope:  "/us-east-1/sts/aws4_request",
+			wantSigned: "content-type;host;x-amz-date;x-amz-security-token",
+		},
+		{
+			name:          "regional endpoint with a server ID and role",
+			auth:          awsAuth{mountPath: "aws", roleName: "app", serverID: "vault.example.com", region: "eu-west-1"},
+			wantURL:       "https://sts.eu-west-1.amazonaws.com/",
+			wantScope:     "/eu-west-1/sts/aws4_request",
+			wantSigned:    "content-type;host;x-amz-date;x-amz-security-token;x-vault-aws-iam-server-id",
+			wantServerID:  "vault.example.com",
+			wantRoleField: "app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.auth.payload(VaultClient{})
+			if err != nil {
+				t.Fatalf("payload() error = %v", err)
+			}
+			decode := func(field string) string {
+				value, err := base64.StdEncoding.DecodeString(payload[field])
+				if err != nil {
+					t.Fatalf("%s is not base64: %s", field, err)
+				}
+				return string(value)
+			}
+
+			if got := payload["iam_http_request_method"]; got != "POST" {
+				t.Errorf("iam_http_request_method = %q, want POST", got)
+			}
+			if got := decode("iam_request_url"); got != tt.wantURL {
+				t.Errorf("iam_request_url = %q, want %q", got, tt.wantURL)
+			}
+			if got := decode("iam_request_body"); got != stsRequestBody {
+				t.Errorf("iam_request_body = %q, want %q", got, stsRequestBody)
+			}
+			if got := payload["role"]; got != tt.wantRoleField {
+				t.Errorf("role = %q, want %q", got, tt.wantRoleField)
+			}
+
+			var headers http.Header
+			if err := json.Unmarshal([]byte(decode("iam_request_headers")), &headers); err != nil {
+				t.Fatalf("iam_request_headers is not JSON: %s", err)
+			}
+			authorization := headers.Get("Authorization")
+			for _, want := range []string{"Credential=ASIAIMDS/", tt.wantScope, "SignedHeaders=" + tt.wantSigned + ","} {
+				if !strings.Contains(authorization, want) {
+					t.Errorf("Authorization = %q, want it to contain %q", authorization, want)
+				}
+			}
+			if got := headers.Get("X-Amz-Security-Token"); got != "imds-session" {
+				t.Errorf("X-Amz-Security-Token = %q, want imds-session", got)
+			}
+			if got := headers.Get(awsIAMServerIDHeader); got != tt.wantServerID {
+				t.Errorf("%s = %q, want %q", awsIAMServerIDHeader, got, tt.wantServerID)
+			}
+		})
+	}
+}
+
+func TestAWSLogin(t *testing.T) {
+	imds := fakeIMDS(false, "app-role")
+	defer imds.Close()
+	withoutAWSCredentials(t)
+	setenv(t, "AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+
+	var loginPath, contentType string
+	var payload map[string]string
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loginPath, contentType = r.Method+" "+r.URL.Path, r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"auth":{"client_token":"aws-token","renewable":true,"lease_duration":3600}}`)
+	}))
+	defer vault.Close()
+	vc := newTestVaultClient(vault)
+
+	lease, err := vc.login(awsAuth{mountPath: "aws-prod", roleName: "app", serverID: "vault.example.com"})
+	if err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	if !lease.Renewable || lease.Duration != time.Hour {
+		t.Errorf("login() = %+v, want a renewable lease of 1h", lease)
+	}
+	if got := vc.token.get(); got != "aws-token" {
+		t.Errorf("token = %q after login, want aws-token", got)
+	}
+	if loginPath != "POST /v1/auth/aws-prod/login" || contentType != "application/json" {
+		t.Errorf("logged in with %s and Content-Type %q, want POST /v1/auth/aws-prod/login with application/json", loginPath, contentType)
+	}
+
+	if payload["role"] != "app" || payload["iam_http_request_method"] != "POST" {
+		t.Errorf("payload = %v, want role app and iam_http_request_method POST", payload)
+	}
+	for _, field := range []string{"iam_request_url", "iam_request_body", "iam_request_headers"} {
+		if payload[field] == "" {
+			t.Errorf("payload has no %s", field)
+		}
+	}
+	signed, err := base64.StdEncoding.DecodeString(payload["iam_request_headers"])
+	if err != nil {
+		t.Fatalf("iam_request_headers is not base64: %s", err)
+	}
+	var headers http.Header
+	if err := json.Unmarshal(signed, &headers); err != nil {
+		t.Fatalf("iam_request_headers is not JSON: %s", err)
+	}
+	if got := headers.Get(awsIAMServerIDHeader); got != "vault.example.com" {
+		t.Errorf("%s = %q, want vault.example.com", awsIAMServerIDHeader, got)
+	}
+	if got := headers.Get("Authorization"); !strings.Contains(got, "x-vault-aws-iam-server-id") {
+		t.Errorf("Authorization = %q, want %s to be signed", got, awsIAMServerIDHeader)
+	}
+}
+
+func TestAWSLoginRejected(t *testing.T) {
+	imds := fakeIMDS(false, "app-role")
+	defer imds.Close()
+	withoutAWSCredentials(t)
+	setenv(t, "AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errors":["expected iam_server_id_header_value vault.example.com"]}`)
+	}))
+	defer vault.Close()
+	vc := newTestVaultClient(vault)
+
+	_, err := vc.login(awsAuth{mountPath: "aws", roleName: "app"})
+	if err == nil || !strings.Contains(err.Error(), "Response code: 400") || !strings.Contains(err.Error(), "iam_server_id_header_value") {
+		t.Errorf("login() error = %v, want Vault's 400", err)
+	}
+	if got := vc.token.get(); got != "" {
+		t.Errorf("token = %q after a failed login, want none", got)
+	}
+}
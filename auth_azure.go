@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	azureAuthType           = "azure"
+	azureIMDSAddrName       = "VAULT_AZURE_IMDS_ADDR"
+	azureResourceName       = "VAULT_AZURE_RESOURCE"
+	azureClientIDName       = "VAULT_AZURE_CLIENT_ID"
+	defaultAzureIMDSAddr    = "http://169.254.169.254"
+	defaultAzureResource    = "https://management.azure.com/"
+	azureTokenAPIVersion    = "2018-02-01"
+	azureInstanceAPIVersion = "2021-02-01"
+)
+
+// azureAuth logs in with the managed identity of an Azure VM, VMSS or AKS
+// node. Besides the identity's access token, Vault needs to know which
+// machine is logging in, which is read from the instance metadata service.
+type azureAuth struct {
+	mountPath string
+	roleName  string
+	imdsAddr  string
+	resource  string
+	clientID  string
+}
+
+func newAzureAuth() azureAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = azureAuthType
+	}
+
+	imdsAddr := strings.TrimSuffix(GetenvSafe(azureIMDSAddrName, false), "/")
+	if imdsAddr == "" {
+		imdsAddr = defaultAzureIMDSAddr
+	}
+	resource := GetenvSafe(azureResourceName, false)
+	if resource == "" {
+		resource = defaultAzureResource
+	}
+
+	return azureAuth{
+		mountPath: mountPath,
+		roleName:  GetenvSafe(authRoleName, true),
+		imdsAddr:  imdsAddr,
+		resource:  resource,
+		// Only needed to pick one of several user-assigned identities.
+		clientID: GetenvSafe(azureClientIDName, false),
+	}
+}
+
+func (a azureAuth) name() string {
+	return azureAuthType
+}
+
+func (a azureAuth) role() string {
+	return a.roleName
+}
+
+func (a azureAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type azureInstanceResponse struct {
+	Compute struct {
+		Name              string `json:"name"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		SubscriptionID    string `json:"subscriptionId"`
+		VMScaleSetName    string `json:"vmScaleSetName"`
+	} `json:"compute"`
+}
+
+func (a azureAuth) payload(vc VaultClient) (map[string]string, error) {
+	httpClient := &http.Client{Timeout: metadataTimeout}
+
+	query := url.Values{"api-version": {azureTokenAPIVersion}, "resource": {a.resource}}
+	if a.clientID != "" {
+		query.Set("client_id", a.clientID)
+	}
+	var token azureTokenResponse
+	if err := a.imds(httpClient, "/metadata/identity/oauth2/token?"+query.Encode(), &token); err != nil {
+		return nil, fmt.Errorf("failed to get managed identity token: %s", err.Error())
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("managed identity token response contains no access_token")
+	}
+
+	var instance azureInstanceResponse
+	if err := a.imds(httpClient, "/metadata/instance?api-version="+azureInstanceAPIVersion, &instance); err != nil {
+		return nil, fmt.Errorf("failed to get instance metadata: %s", err.Error())
+	}
+
+	payload := map[string]string{
+		"role":                a.roleName,
+		"jwt":                 token.AccessToken,
+		"subscription_id":     instance.Compute.SubscriptionID,
+		"resource_group_name": instance.Compute.ResourceGroupName,
+	}
+	// Vault expects either the scale set or the VM, not both.
+	if instance.Compute.VMScaleSetName != "" {
+		payload["vmss_name"] = instance.Compute.VMScaleSetName
+	} else {
+		payload["vm_name"] = instance.Compute.Name
+	}
+	return payload, nil
+}
+
+func (a azureAuth) imds(httpClient *http.Client, path string, out interface{}) error {
+	req, err := http.NewRequest("GET", a.imdsAddr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+
+	body, err := metadataRequest(httpClient, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeAzureIMDS stands in for the Azure instance metadata service, serving
+// instance as the compute metadata and an access token for any request with
+// the Metadata header. The token request's query is recorded in tokenQuery.
+func fakeAzureIMDS(instance string, tokenQuery *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			*tokenQuery = r.URL.RawQuery
+			w.Write([]byte(`{"access_token":"azure-token","expires_in":"3599","token_type":"Bearer"}`))
+		case "/metadata/instance":
+			w.Write([]byte(instance))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAzureAuthPayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		clientID  string
+		instance  string
+		wantQuery string
+		want      map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "virtual machine",
+			instance:  `{"compute":{"name":"vm-1","resourceGroupName":"rg","subscriptionId":"sub","vmScaleSetName":""}}`,
+			wantQuery: "api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F",
+			want: map[string]string{
+				"role": "app", "jwt": "azure-token", "subscription_id": "sub", "resource_group_name": "rg", "vm_name": "vm-1",
+			},
+		},
+		{
+			name:      "scale set with a user-assigned identity",
+			clientID:  "client-1",
+			instance:  `{"compute":{"name":"aks-nodepool_0","resourceGroupName":"rg","subscriptionId":"sub","vmScaleSetName":"aks-nodepool"}}`,
+			wantQuery: "api-version=2018-02-01&client_id=client-1&resource=https%3A%2F%2Fmanagement.azure.com%2F",
+			want: map[string]string{
+				"role": "app", "jwt": "azure-token", "subscription_id": "sub", "resource_group_name": "rg", "vmss_name": "aks-nodepool",
+			},
+		},
+		{
+			name:     "malformed instance metadata",
+			instance: `<html>`,
+			wantErr:  "failed to get instance metadata",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenQuery string
+			imds := fakeAzureIMDS(tt.instance, &tokenQuery)
+			defer imds.Close()
+
+			auth := azureAuth{mountPath: "azure", roleName: "app", imdsAddr: imds.URL, resource: defaultAzureResource, clientID: tt.clientID}
+			payload, err := auth.payload(VaultClient{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("payload() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("payload() error = %v", err)
+			}
+			if !reflect.DeepEqual(payload, tt.want) {
+				t.Errorf("payload() = %v, want %v", payload, tt.want)
+			}
+			if tokenQuery != tt.wantQuery {
+				t.Errorf("token requested with %q, want %q", tokenQuery, tt.wantQuery)
+			}
+		})
+	}
+}
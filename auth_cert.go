@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const certAuthType = "cert"
+
+// certAuth logs in with the TLS client certificate configured with
+// VAULT_CLIENT_CERT and VAULT_CLIENT_KEY. The identity is the certificate
+// presented during the handshake, so the payload only names the role.
+type certAuth struct {
+	mountPath string
+	roleName  string
+}
+
+func newCertAuth() certAuth {
+	if GetenvSafe(clientCertName, false) == "" {
+		log.Fatalf("ERROR: cert auth needs a client certificate in %s and %s", clientCertName, clientKeyName)
+	}
+
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = certAuthType
+	}
+
+	// Without a role Vault tries every role of the mount that trusts the
+	// certificate.
+	return certAuth{mountPath: mountPath, roleName: GetenvSafe(authRoleName, false)}
+}
+
+func (a certAuth) name() string {
+	return certAuthType
+}
+
+func (a certAuth) role() string {
+	return a.roleName
+}
+
+func (a certAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+func (a certAuth) payload(vc VaultClient) (map[string]string, error) {
+	payload := map[string]string{}
+	if a.roleName != "" {
+		payload["name"] = a.roleName
+	}
+	return payload, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gcpAuthType               = "gcp"
+	gcpAuthTypeName           = "VAULT_GCP_AUTH_TYPE"
+	gcpServiceAccountName     = "VAULT_GCP_SERVICE_ACCOUNT"
+	gcpIAMCredentialsAddrName = "VAULT_GCP_IAM_CREDENTIALS_ADDR"
+	gcpGCEType                = "gce"
+	gcpIAMType                = "iam"
+	defaultGCEMetadataHost    = "metadata.google.internal"
+	gceServiceAccountPath     = "/computeMetadata/v1/instance/service-accounts/default/"
+	defaultIAMCredentialsAddr = "https://iamcredentials.googleapis.com"
+	iamCredentialsSignJWT     = "/v1/projects/-/serviceAccounts/%s:signJwt"
+	gcpJWTLifetime            = 10 * time.Minute
+)
+
+// gcpAuth logs in with the Google identity of the workload, so GKE, Cloud
+// Run and GCE workloads don't need a long-lived token secret. With the
+// default `gce` type it presents an identity token minted by the metadata
+// server; with the `iam` type it has the IAM credentials API sign a JWT for
+// the service account.
+type gcpAuth struct {
+	mountPath      string
+	roleName       string
+	authType       string
+	serviceAccount string
+	// iamCredentialsAddr is the address of the IAM credentials API.
+	iamCredentialsAddr string
+}
+
+func newGCPAuth() gcpAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = gcpAuthType
+	}
+
+	authType := GetenvSafe(gcpAuthTypeName, false)
+	switch authType {
+	case "":
+		authType = gcpGCEType
+	case gcpGCEType, gcpIAMType:
+	default:
+		log.Fatalf("ERROR: unsupported %s '%s', must be %s or %s", gcpAuthTypeName, authType, gcpGCEType, gcpIAMType)
+	}
+
+	iamCredentialsAddr := strings.TrimSuffix(GetenvSafe(gcpIAMCredentialsAddrName, false), "/")
+	if iamCredentialsAddr == "" {
+		iamCredentialsAddr = defaultIAMCredentialsAddr
+	}
+
+	return gcpAuth{
+		mountPath:          mountPath,
+		roleName:           GetenvSafe(authRoleName, true),
+		authType:           authType,
+		serviceAccount:     GetenvSafe(gcpServiceAccountName, false),
+		iamCredentialsAddr: iamCredentialsAddr,
+	}
+}
+
+func (a gcpAuth) name() string {
+	return gcpAuthType
+}
+
+func (a gcpAuth) role() string {
+	return a.roleName
+}
+
+func (a gcpAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+// audience is the audience Vault's GCP auth method expects tokens for.
+func (a gcpAuth) audience() string {
+	return fmt.Sprintf("vault/%s", a.roleName)
+}
+
+func (a gcpAuth) payload(vc VaultClient) (map[string]string, error) {
+	var jwt string
+	var err error
+
+	httpClient := &http.Client{Timeout: metadataTimeout}
+	if a.authType == gcpIAMType {
+		jwt, err = a.signServiceAccountJWT(httpClient)
+	} else {
+		jwt, err = gceMetadata(httpClient, "identity?"+url.Values{"audience": {a.audience()}, "format": {"full"}}.Encode())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"role": a.roleName, "jwt": jwt}, nil
+}
+
+type signJWTResponse struct {
+	SignedJWT string `json:"signedJwt"`
+}
+
+// signServiceAccountJWT has the IAM credentials API sign a short-lived JWT
+// for the service account, authenticating with the metadata server's access
+// token.
+func (a gcpAuth) signServiceAccountJWT(httpClient *http.Client) (string, error) {
+	serviceAccount := a.serviceAccount
+	if serviceAccount == "" {
+		var err error
+		if serviceAccount, err = gceMetadata(httpClient, "email"); err != nil {
+			return "", err
+		}
+	}
+
+	tokenJSON, err := gceMetadata(httpClient, "token")
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+		return "", fmt.Errorf("failed to unmarshal metadata server access token: %s", err.Error())
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": a.audience(),
+		"sub": serviceAccount,
+		"exp": time.Now().Add(gcpJWTLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"payload": string(claims)})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", a.iamCredentialsAddr+fmt.Sprintf(iamCredentialsSignJWT, url.PathEscape(serviceAccount)), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	respBody, err := metadataRequest(httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT for %s: %s", serviceAccount, err.Error())
+	}
+	var resp signJWTResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return "", fmt.Errorf("failed to unmarshal signJwt response: %s", err.Error())
+	}
+	if resp.SignedJWT == "" {
+		return "", errors.New("signJwt response contains no JWT")
+	}
+	return resp.SignedJWT, nil
+}
+
+// gceMetadata reads path under the default service account from the GCE
+// metadata server. GCE_METADATA_HOST overrides its address.
+func gceMetadata(httpClient *http.Client, path string) (string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s%s", host, gceServiceAccountPath, path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	body, err := metadataRequest(httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GCE metadata: %s", err.Error())
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCPAuthPayload(t *testing.T) {
+	var audience, format string
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != gceServiceAccountPath+"identity" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		audience, format = r.URL.Query().Get("audience"), r.URL.Query().Get("format")
+		w.Write([]byte("gce-identity-token\n"))
+	}))
+	defer metadata.Close()
+	setenv(t, "GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	auth := gcpAuth{mountPath: "gcp", roleName: "app", authType: gcpGCEType}
+	payload, err := auth.payload(VaultClient{})
+	if err != nil {
+		t.Fatalf("payload() error = %v", err)
+	}
+	if payload["role"] != "app" || payload["jwt"] != "gce-identity-token" || len(payload) != 2 {
+		t.Errorf("payload() = %v, want role app and jwt gce-identity-token", payload)
+	}
+	if audience != "vault/app" || format != "full" {
+		t.Errorf("identity requested with audience %q and format %q, want vault/app and full", audience, format)
+	}
+}
+
+func TestGCPAuthPayloadMetadataError(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer metadata.Close()
+	setenv(t, "GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	auth := gcpAuth{mountPath: "gcp", roleName: "app", authType: gcpGCEType}
+	if _, err := auth.payload(VaultClient{}); err == nil || !strings.Contains(err.Error(), "Response code: 404") {
+		t.Errorf("payload() error = %v, want the metadata server's 404", err)
+	}
+}
+
+// fakeIAMCredentials stands in for both the metadata server, serving the
+// default service account's email and access token, and the IAM
+// credentials API, answering signJwt with signStatus and signResponse. The
+// path, Authorization header and body of the signJwt request are recorded.
+type fakeIAMCredentials struct {
+	signStatus   int
+	signResponse string
+	signPath     string
+	signAuth     string
+	signBody     string
+}
+
+func (f *fakeIAMCredentials) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case gceServiceAccountPath + "email":
+		w.Write([]byte("app@project.iam.gserviceaccount.com\n"))
+	case gceServiceAccountPath + "token":
+		w.Write([]byte(`{"access_token":"metadata-token","expires_in":3599,"token_type":"Bearer"}`))
+	default:
+		if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, ":signJwt") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.signPath, f.signAuth, f.signBody = r.URL.EscapedPath(), r.Header.Get("Authorization"), string(body)
+		if f.signStatus != 0 {
+			w.WriteHeader(f.signStatus)
+		}
+		w.Write([]byte(f.signResponse))
+	}
+}
+
+func TestGCPAuthPayloadIAM(t *testing.T) {
+	tests := []struct {
+		name           string
+		serviceAccount string
+		signStatus     int
+		signResponse   string
+		wantAccount    string
+		wantErr        string
+	}{
+		{
+			name:         "default service account",
+			signResponse: `{"keyId":"k1","signedJwt":"signed-jwt"}`,
+			wantAccount:  "app@project.iam.gserviceaccount.com",
+		},
+		{
+			name:           "configured service account",
+			serviceAccount: "deployer@project.iam.gserviceaccount.com",
+			signResponse:   `{"keyId":"k1","signedJwt":"signed-jwt"}`,
+			wantAccount:    "deployer@project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "signing denied",
+			signStatus:   http.StatusForbidden,
+			signResponse: `{"error":{"code":403,"status":"PERMISSION_DENIED"}}`,
+			wantAccount:  "app@project.iam.gserviceaccount.com",
+			wantErr:      "failed to sign JWT for app@project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "no JWT in the response",
+			signResponse: `{"keyId":"k1"}`,
+			wantAccount:  "app@project.iam.gserviceaccount.com",
+			wantErr:      "signJwt response contains no JWT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeIAMCredentials{signStatus: tt.signStatus, signResponse: tt.signResponse}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			setenv(t, "GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+			auth := gcpAuth{mountPath: "gcp", roleName: "app", authType: gcpIAMType, serviceAccount: tt.serviceAccount, iamCredentialsAddr: server.URL}
+			payload, err := auth.payload(VaultClient{})
+			if wantPath := "/v1/projects/-/serviceAccounts/" + tt.wantAccount + ":signJwt"; fake.signPath != wantPath {
+				t.Errorf("signJwt requested at %q, want %q", fake.signPath, wantPath)
+			}
+			if fake.signAuth != "Bearer metadata-token" {
+				t.Errorf("signJwt Authorization = %q, want the metadata server's access token", fake.signAuth)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("payload() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("payload() error = %v", err)
+			}
+			if payload["role"] != "app" || payload["jwt"] != "signed-jwt" || len(payload) != 2 {
+				t.Errorf("payload() = %v, want role app and jwt signed-jwt", payload)
+			}
+
+			var body struct {
+				Payload string `json:"payload"`
+			}
+			if err := json.Unmarshal([]byte(fake.signBody), &body); err != nil {
+				t.Fatalf("signJwt body %q is not JSON: %s", fake.signBody, err)
+			}
+			var claims struct {
+				Aud string `json:"aud"`
+				Sub string `json:"sub"`
+				Exp int64  `json:"exp"`
+			}
+			if err := json.Unmarshal([]byte(body.Payload), &claims); err != nil {
+				t.Fatalf("signJwt payload %q is not JSON: %s", body.Payload, err)
+			}
+			if claims.Aud != "vault/app" || claims.Sub != tt.wantAccount {
+				t.Errorf("claims = %+v, want aud vault/app and sub %s", claims, tt.wantAccount)
+			}
+			if expiry := time.Until(time.Unix(claims.Exp, 0)); expiry <= gcpJWTLifetime-time.Minute || expiry > gcpJWTLifetime {
+				t.Errorf("claims expire in %s, want %s", expiry, gcpJWTLifetime)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	jwtAuthType        = "jwt"
+	jwtToken           = "VAULT_JWT"
+	jwtAudienceName    = "VAULT_JWT_AUDIENCE"
+	spiffeEndpointName = "SPIFFE_ENDPOINT_SOCKET"
+	defaultJWTAudience = "vault"
+)
+
+// jwtAuth logs in to the JWT/OIDC auth method with any signed JWT Vault is
+// configured to trust: SPIRE JWT-SVIDs, GitHub Actions OIDC tokens, Nomad
+// workload identities and so on. The token is read from VAULT_JWT, the file
+// named by VAULT_JWT_FILE or, when neither is set, fetched as a JWT-SVID
+// from the SPIFFE Workload API at SPIFFE_ENDPOINT_SOCKET.
+type jwtAuth struct {
+	mountPath      string
+	roleName       string
+	jwt            credentialSource
+	spiffeEndpoint string
+	audience       string
+}
+
+func newJWTAuth() jwtAuth {
+	mountPath := authMountPath(GetenvSafe(authPathName, false))
+	if mountPath == "" {
+		mountPath = jwtAuthType
+	}
+
+	auth := jwtAuth{
+		mountPath: mountPath,
+		// The role may be left out when the mount has a default_role.
+		roleName: GetenvSafe(authRoleName, false),
+		jwt:      newCredentialSource(jwtToken, false),
+	}
+	if auth.jwt.isSet() {
+		return auth
+	}
+
+	auth.spiffeEndpoint = GetenvSafe(spiffeEndpointName, false)
+	if auth.spiffeEndpoint == "" {
+		log.Fatalf("ERROR: jwt auth needs one of %s, %s_FILE or %s", jwtToken, jwtToken, spiffeEndpointName)
+	}
+	auth.audience = GetenvSafe(jwtAudienceName, false)
+	if auth.audience == "" {
+		auth.audience = defaultJWTAudience
+	}
+	return auth
+}
+
+func (a jwtAuth) name() string {
+	return jwtAuthType
+}
+
+func (a jwtAuth) role() string {
+	return a.roleName
+}
+
+func (a jwtAuth) loginPath() string {
+	return fmt.Sprintf("auth/%s/login", a.mountPath)
+}
+
+func (a jwtAuth) payload(vc VaultClient) (map[string]string, error) {
+	var jwt string
+	var err error
+
+	if a.spiffeEndpoint != "" {
+		jwt, err = fetchJWTSVID(a.spiffeEndpoint, a.audience)
+	} else {
+		jwt, err = a.jwt.load()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.Count(jwt, ".") != 2 {
+		return nil, errors.New("the provided token is not a JWT")
+	}
+
+	payload := map[string]string{"jwt": jwt}
+	if a.roleName != "" {
+		payload["role"] = a.roleName
+	}
+	return payload, nil
+}
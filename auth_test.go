@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// withNamespace makes the pod's namespace read as namespace for the duration
+// of the test.
+func withNamespace(t *testing.T, namespace string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "namespace")
+	if err := ioutil.WriteFile(path, []byte(namespace+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	previous := namespacePath
+	namespacePath = path
+	t.Cleanup(func() { namespacePath = previous })
+}
+
+func TestNewKubernetesAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		role          string
+		authPath      string
+		wantRole      string
+		wantLoginPath string
+	}{
+		{
+			name:          "defaults",
+			wantRole:      "team-a-vault-sa",
+			wantLoginPath: "auth/kubernetes-gke-1/login",
+		},
+		{
+			name:          "role from VAULT_ROLE",
+			role:          "app",
+			wantRole:      "app",
+			wantLoginPath: "auth/kubernetes-gke-1/login",
+		},
+		{
+			name:          "mount path from VAULT_AUTH_PATH",
+			authPath:      "/auth/k8s/",
+			wantRole:      "team-a-vault-sa",
+			wantLoginPath: "auth/k8s/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withNamespace(t, "team-a")
+			setenv(t, "KUBERNETES_CLUSTER", "gke-1")
+			setenv(t, authRoleName, tt.role)
+			setenv(t, authPathName, tt.authPath)
+			setenv(t, kubernetesJWT, "sa-token")
+			setenv(t, kubernetesJWT+"_FILE", "")
+
+			auth := newKubernetesAuth()
+			if auth.role() != tt.wantRole {
+				t.Errorf("role() = %q, want %q", auth.role(), tt.wantRole)
+			}
+			if auth.loginPath() != tt.wantLoginPath {
+				t.Errorf("loginPath() = %q, want %q", auth.loginPath(), tt.wantLoginPath)
+			}
+			payload, err := auth.payload(VaultClient{})
+			if err != nil {
+				t.Fatalf("payload() error = %v", err)
+			}
+			if payload["jwt"] != "sa-token" || payload["role"] != tt.wantRole {
+				t.Errorf("payload() = %v, want the token and role %s", payload, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestKubernetesAuthTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", tokenFile, err)
+	}
+	setenv(t, authRoleName, "app")
+	setenv(t, authPathName, "kubernetes")
+	setenv(t, kubernetesJWT, "ignored")
+	setenv(t, kubernetesJWT+"_FILE", tokenFile)
+
+	auth := newKubernetesAuth()
+	payload, err := auth.payload(VaultClient{})
+	if err != nil {
+		t.Fatalf("payload() error = %v", err)
+	}
+	if payload["jwt"] != "first-token" {
+		t.Errorf("payload() jwt = %q, want the token from the file", payload["jwt"])
+	}
+
+	// Projected tokens are rotated on disk; logging in again picks that up.
+	if err := ioutil.WriteFile(tokenFile, []byte("rotated-token"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", tokenFile, err)
+	}
+	if payload, _ = auth.payload(VaultClient{}); payload["jwt"] != "rotated-token" {
+		t.Errorf("payload() jwt = %q after rotation, want rotated-token", payload["jwt"])
+	}
+
+	if err := ioutil.WriteFile(tokenFile, nil, 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", tokenFile, err)
+	}
+	if _, err := auth.payload(VaultClient{}); err == nil {
+		t.Errorf("payload() with an empty token file succeeded, want an error")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metadataTimeout         = 5 * time.Second
+	defaultIMDSEndpoint     = "http://169.254.169.254"
+	ecsCredentialsEndpoint  = "http://169.254.170.2"
+	imdsTokenTTLSeconds     = "21600"
+	awsSigningAlgorithm     = "AWS4-HMAC-SHA256"
+	awsAmzDateFormat        = "20060102T150405Z"
+	awsShortDateFormat      = "20060102"
+	defaultAWSProfile       = "default"
+	defaultAWSRegion        = "us-east-1"
+	imdsCredentialsBasePath = "/latest/meta-data/iam/security-credentials/"
+)
+
+// awsCredentials are the keys requests to AWS are signed with.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// loadAWSCredentials looks up credentials the way the AWS SDKs do: the
+// environment, then the shared credentials file, then the ECS container
+// endpoint and finally the EC2 instance metadata service.
+func loadAWSCredentials() (awsCredentials, error) {
+	if creds, ok := awsCredentialsFromEnv(); ok {
+		return creds, nil
+	}
+
+	creds, ok, err := awsCredentialsFromSharedFile()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if ok {
+		return creds, nil
+	}
+
+	httpClient := &http.Client{Timeout: metadataTimeout}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return awsCredentialsFromECS(httpClient)
+	}
+	return awsCredentialsFromIMDS(httpClient)
+}
+
+func awsCredentialsFromEnv() (awsCredentials, bool) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != ""
+}
+
+func awsCredentialsFromSharedFile() (awsCredentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	if isSecretFile(path) {
+		// Credentials issued by Vault, not the workload's own.
+		return awsCredentials{}, false, nil
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = defaultAWSProfile
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, false, nil
+	} else if err != nil {
+		return awsCredentials{}, false, fmt.Errorf("failed to open AWS shared credentials file %s: %s", path, err.Error())
+	}
+	defer file.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, false, fmt.Errorf("failed to read AWS shared credentials file %s: %s", path, err.Error())
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != "", nil
+}
+
+// awsCredentialsFromECS reads the task role credentials ECS exposes to
+// containers.
+func awsCredentialsFromECS(httpClient *http.Client) (awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = ecsCredentialsEndpoint + relative
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, err := metadataRequest(httpClient, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get ECS container credentials: %s", err.Error())
+	}
+	return parseAWSCredentials(body)
+}
+
+// awsCredentialsFromIMDS reads the instance profile credentials from the
+// EC2 instance metadata service, using an IMDSv2 session token when the
+// service hands one out. AWS_EC2_METADATA_SERVICE_ENDPOINT overrides its
+// address.
+func awsCredentialsFromIMDS(httpClient *http.Client) (awsCredentials, error) {
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = defaultIMDSEndpoint
+	}
+
+	token := ""
+	if req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil); err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", imdsTokenTTLSeconds)
+		if body, err := metadataRequest(httpClient, req); err == nil {
+			token = string(body)
+		}
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		return metadataRequest(httpClient, req)
+	}
+
+	roles, err := get(imdsCredentialsBasePath)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials found in the environment, shared credentials file or instance metadata: %s", err.Error())
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, errors.New("the instance has no IAM role attached")
+	}
+
+	body, err := get(imdsCredentialsBasePath + role)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get credentials for instance role %s: %s", role, err.Error())
+	}
+	return parseAWSCredentials(body)
+}
+
+func parseAWSCredentials(body []byte) (awsCredentials, error) {
+	var creds awsCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to unmarshal AWS credentials: %s", err.Error())
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("AWS credentials response has no access key")
+	}
+	return creds, nil
+}
+
+// metadataRequest sends a request to a metadata service and returns the body
+// of a 200 response.
+func metadataRequest(httpClient *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s %s - Response code: %d", req.Method, req.URL, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// signAWSRequest signs req with AWS Signature Version 4. Every header set on
+// req, plus Host, is signed.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsAmzDateFormat)
+	shortDate := now.UTC().Format(awsShortDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", shortDate, region, service)
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), shortDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
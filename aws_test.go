@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// The examples from the AWS Signature Version 4 documentation and test
+// suite, which all sign with these credentials at 2015-08-30T12:36:00Z.
+func TestSignAWSRequest(t *testing.T) {
+	exampleCreds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	exampleTime := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		token   string
+		service string
+		want    string
+	}{
+		{
+			name:    "IAM ListUsers",
+			method:  "GET",
+			url:     "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			service: "iam",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date, " +
+				"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+		{
+			name:    "get-vanilla",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "post-sts-header-before",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			token:   "AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA==",
+			service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date;x-amz-security-token, " +
+				"Signature=85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			creds := exampleCreds
+			creds.SessionToken = tt.token
+
+			signAWSRequest(req, nil, creds, "us-east-1", tt.service, exampleTime)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q\nwant %q", got, tt.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q, want 20150830T123600Z", got)
+			}
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tt.token {
+				t.Errorf("X-Amz-Security-Token = %q, want %q", got, tt.token)
+			}
+		})
+	}
+}
+
+// fakeIMDS stands in for the EC2 instance metadata service. With imdsV1 it
+// refuses session tokens, as instances that predate IMDSv2 do.
+func fakeIMDS(imdsV1 bool, role string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			if imdsV1 || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("imds-token"))
+			return
+		}
+		if !imdsV1 && r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case imdsCredentialsBasePath:
+			w.Write([]byte(role))
+		case imdsCredentialsBasePath + role:
+			w.Write([]byte(`{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"ASIAIMDS","SecretAccessKey":"imds-secret","Token":"imds-session"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// withoutAWSCredentials clears the credentials loadAWSCredentials looks up
+// before the metadata services.
+func withoutAWSCredentials(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		setenv(t, name, "")
+	}
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+}
+
+func TestAWSCredentialsFromIMDS(t *testing.T) {
+	tests := []struct {
+		name    string
+		imdsV1  bool
+		role    string
+		wantErr string
+	}{
+		{name: "IMDSv2", role: "app-role"},
+		{name: "IMDSv1", imdsV1: true, role: "app-role"},
+		{name: "no instance role", wantErr: "no IAM role attached"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imds := fakeIMDS(tt.imdsV1, tt.role)
+			defer imds.Close()
+			withoutAWSCredentials(t)
+			setenv(t, "AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL+"/")
+
+			creds, err := loadAWSCredentials()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAWSCredentials() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAWSCredentials() error = %v", err)
+			}
+			want := awsCredentials{AccessKeyID: "ASIAIMDS", SecretAccessKey: "imds-secret", SessionToken: "imds-session"}
+			if creds != want {
+				t.Errorf("loadAWSCredentials() = %+v, want %+v", creds, want)
+			}
+		})
+	}
+}
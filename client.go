@@ -2,65 +2,52 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
 
-	"github.com/sethgrid/pester"
+const (
+	vaultNamespaceName   = "VAULT_NAMESPACE"
+	vaultNamespaceHeader = "X-Vault-Namespace"
 )
 
-func newPesterClient(httpClient *http.Client) *pester.Client {
-	pesterClient := pester.NewExtendedClient(httpClient)
-	pesterClient.Concurrency = 1
-	pesterClient.MaxRetries = 5
-	pesterClient.Backoff = pester.ExponentialBackoff
-	pesterClient.KeepLog = true
-	return pesterClient
+func PrepareHTTPSClient() *http.Client {
+	transport := &http.Transport{TLSClientConfig: newTLSConfig()}
+	return &http.Client{Transport: transport}
 }
 
-func PrepareHTTPSClient() *pester.Client {
-	sysCertStoreFailed := false
-	embeddedCertFailed := false
-
-	certPool, err := x509.SystemCertPool()
-	if err != nil || certPool == nil {
-		sysCertStoreFailed = true
-		certPool = x509.NewCertPool()
-		log.Println("INFO: PrepareHTTPClient() failed to get the system's cert store; using embedded cert")
-	}
-	ok := certPool.AppendCertsFromPEM([]byte(PinnedCert))
-	if !ok {
-		embeddedCertFailed = false
-		log.Println("INFO: PrepareHTTPClient() failed to parse the embedded cert; using system cert store")
-	}
-
-	if sysCertStoreFailed && embeddedCertFailed {
-		log.Fatal("ERROR: Both embedded cert and system cert store failed.")
-	}
-
-	tlsConfig := &tls.Config{
-		RootCAs: certPool,
-	}
-	tlsConfig.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	client := &http.Client{Transport: transport}
+// VaultV1Data holds the decoded key/value pairs of a secret. Numbers are
+// kept as json.Number so they are rendered exactly as they were written.
+type VaultV1Data map[string]interface{}
 
-	return newPesterClient(client)
+type VaultV2Metadata struct {
+	CreatedTime  string `json:"created_time"`
+	DeletionTime string `json:"deletion_time"`
+	Destroyed    bool   `json:"destroyed"`
+	Version      int    `json:"version"`
 }
 
-type VaultV1Data map[string]string
-
 type VaultV2Data struct {
-	Data VaultV1Data `json:"data"`
+	Data     VaultV1Data     `json:"data"`
+	Metadata VaultV2Metadata `json:"metadata"`
 }
 
 type VaultReadResponse interface {
 	GetSecret(string) (string, error)
+	GetData() VaultV1Data
+	// GetVersion returns the KV v2 version that was read, or 0 for a KV v1
+	// secret.
+	GetVersion() int
+	// GetLease returns the lease of a dynamic secret; secrets from KV have
+	// none.
+	GetLease() vaultLease
 }
 
 type VaultBaseResponse struct {
@@ -72,6 +59,31 @@ type VaultBaseResponse struct {
 	LeaseDuration int      `json:"lease_duration" yaml:"lease_duration" `
 }
 
+// GetLease returns the lease Vault attached to the response, if any.
+func (r VaultBaseResponse) GetLease() vaultLease {
+	return vaultLease{
+		ID:        r.LeaseID,
+		Renewable: r.Renewable,
+		Duration:  time.Duration(r.LeaseDuration) * time.Second,
+	}
+}
+
+func decodeVaultResponse(data []byte, resp interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(resp)
+}
+
+func getSecret(data VaultV1Data, key string) (string, error) {
+	var value interface{}
+	var ok bool
+
+	if value, ok = data[key]; !ok {
+		return "", NewSecretNotFoundError(fmt.Sprintf("no value for key: %s", key))
+	}
+	return formatValue(value)
+}
+
 type VaultV1Response struct {
 	VaultBaseResponse
 	Data VaultV1Data `json:"data" yaml:"data" `
@@ -80,20 +92,22 @@ type VaultV1Response struct {
 func NewVaultV1Response(data []byte) (VaultReadResponse, error) {
 	var resp VaultV1Response
 
-	if err := json.Unmarshal(data, &resp); err != nil {
+	if err := decodeVaultResponse(data, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
 func (r VaultV1Response) GetSecret(key string) (string, error) {
-	var value string
-	var ok bool
+	return getSecret(r.Data, key)
+}
 
-	if value, ok = r.Data[key]; !ok {
-		return "", errors.New(fmt.Sprintf("no value for key: %s", key))
-	}
-	return value, nil
+func (r VaultV1Response) GetData() VaultV1Data {
+	return r.Data
+}
+
+func (r VaultV1Response) GetVersion() int {
+	return 0
 }
 
 type VaultV2Response struct {
@@ -104,131 +118,299 @@ type VaultV2Response struct {
 func NewVaultV2Response(data []byte) (VaultReadResponse, error) {
 	var resp VaultV2Response
 
-	if err := json.Unmarshal(data, &resp); err != nil {
+	if err := decodeVaultResponse(data, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
 func (r VaultV2Response) GetSecret(key string) (string, error) {
-	var value string
-	var ok bool
+	return getSecret(r.Data.Data, key)
+}
 
-	if value, ok = r.Data.Data[key]; !ok {
-		return "", errors.New(fmt.Sprintf("no value for key: %s", key))
-	}
-	return value, nil
+func (r VaultV2Response) GetData() VaultV1Data {
+	return r.Data.Data
+}
+
+func (r VaultV2Response) GetVersion() int {
+	return r.Data.Metadata.Version
+}
+
+// SecretNotFoundError is returned when a path, version or key doesn't exist
+// in Vault, as opposed to failures to reach or be authorised by Vault.
+type SecretNotFoundError struct {
+	Message string
+}
+
+func (e SecretNotFoundError) Error() string {
+	return e.Message
+}
+
+// NewSecretNotFoundError creates a new `SecretNotFoundError`.
+func NewSecretNotFoundError(message string) SecretNotFoundError {
+	return SecretNotFoundError{Message: message}
+}
+
+// VaultStatusError is returned when Vault answers a request with an
+// unexpected status code.
+type VaultStatusError struct {
+	Message    string
+	StatusCode int
+}
+
+func (e VaultStatusError) Error() string {
+	return e.Message
+}
+
+// NewVaultStatusError creates a new `VaultStatusError`.
+func NewVaultStatusError(message string, statusCode int) VaultStatusError {
+	return VaultStatusError{Message: message, StatusCode: statusCode}
 }
 
 type VaultClient struct {
-	vaultAddress   string
-	cluster        string
-	jwt            string
-	authURL        string
+	nodes          *vaultNodes
+	client         *retryClient
+	token          *vaultToken
 	namespace      string
-	role           string
-	client         *pester.Client
-	token          string
 	BackendVersion string
+	mounts         *mountCache
 }
 
 var vaultClient *VaultClient
 
 func NewVaultClient() *VaultClient {
 	if vaultClient == nil {
-		vaultAddress := GetenvSafe("VAULT_ADDR", true)
-		cluster := GetenvSafe("KUBERNETES_CLUSTER", true)
-		jwt := GetenvSafe("VAULT_SERVICE_ACCOUNT_JWT", true)
-		authURL := fmt.Sprintf("%s/v1/auth/kubernetes-%s/login", vaultAddress, cluster)
-		namespace := GetNamespace()
-		role := fmt.Sprintf("%s-vault-sa", namespace)
-		client := PrepareHTTPSClient()
+		httpClient := PrepareHTTPSClient()
+		nodes := newVaultNodes(GetenvSafe(vaultAddrName, true), httpClient)
+		nodes.selectHealthy()
 		vaultBackendVersion := GetenvSafe("VAULT_KV_VERSION", false)
 		token := GetenvSafe("VAULT_TOKEN", false)
 
 		vaultClient = &VaultClient{
-			vaultAddress:   vaultAddress,
-			cluster:        cluster,
-			jwt:            jwt,
-			authURL:        authURL,
-			namespace:      namespace,
-			role:           role,
-			client:         client,
+			nodes:          nodes,
+			client:         newRetryClient(httpClient, newRetryPolicy()),
 			BackendVersion: vaultBackendVersion,
-			token:          token,
+			token:          &vaultToken{value: token},
+			namespace:      GetenvSafe(vaultNamespaceName, false),
+			mounts:         newMountCache(),
 		}
 	}
 	return vaultClient
 }
 
-func (vc VaultClient) payloadJSON() []byte {
-	if payload, err := json.Marshal(map[string]string{"jwt": vc.jwt, "role": vc.role}); err != nil {
-		log.Fatalf("error creating vault JSON payload: %s", err.Error())
-	} else {
-		return payload
+func (vc VaultClient) payloadJSON(method authMethod) ([]byte, error) {
+	payload, err := method.payload(vc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault JSON payload: %s", err.Error())
 	}
-	return nil
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault JSON payload: %s", err.Error())
+	}
+	return payloadJSON, nil
 }
 
-func (vc VaultClient) newAuthRequest() *http.Request {
-	var req *http.Request
-	var err error
+func (vc VaultClient) authURL(method authMethod) string {
+	return fmt.Sprintf("%s/v1/%s", vc.nodes.address(), method.loginPath())
+}
 
-	if req, err = http.NewRequest(http.MethodPost, vc.authURL, bytes.NewBuffer(vc.payloadJSON())); err != nil {
-		log.Fatalf("error creating vault auth request: %s", err.Error())
+func (vc VaultClient) newAuthRequest(method authMethod) (*http.Request, error) {
+	payload, err := vc.payloadJSON(method)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "/v1/"+method.loginPath(), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault auth request: %s", err.Error())
 	}
 	req.Header.Set("Content-Type", "application/json")
-	return req
+	vc.setNamespace(req, "")
+	return req, nil
 }
 
-func (vc VaultClient) newReadSecretRequest(secretPath string) *http.Request {
+// newRequest creates a request for the Vault API at path, authenticated with
+// the client's token when it has one. Its URL is relative; do resolves it
+// against the Vault node the request is sent to.
+func (vc VaultClient) newRequest(method, path string, body []byte) *http.Request {
 	var req *http.Request
 	var err error
 
-	secretURL := fmt.Sprintf("%s/v1/%s", vc.vaultAddress, secretPath)
-	if req, err = http.NewRequest("GET", secretURL, nil); err != nil {
-		log.Fatalf("error creating vault read request: %s", err.Error())
+	requestURL := "/v1/" + path
+	if req, err = http.NewRequest(method, requestURL, bytes.NewReader(body)); err != nil {
+		log.Fatalf("error creating vault request: %s", err.Error())
 	}
-	req.Header.Set("X-Vault-Token", vc.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := vc.token.get(); token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	vc.setNamespace(req, "")
 	return req
 }
 
-func (vc VaultClient) auth() (*http.Response, error) {
-	req := vc.newAuthRequest()
-	return vc.client.Do(req)
+// joinNamespace resolves a namespace given relative to VAULT_NAMESPACE into
+// the full namespace path Vault expects. Either may have leading or trailing
+// slashes, which are dropped.
+func (vc VaultClient) joinNamespace(namespace string) string {
+	parent := strings.Trim(vc.namespace, "/")
+	namespace = strings.Trim(namespace, "/")
+	if parent == "" {
+		return namespace
+	}
+	if namespace == "" {
+		return parent
+	}
+	return parent + "/" + namespace
 }
 
-func (vc VaultClient) readSecret(secretPath string) (VaultReadResponse, error) {
-	req := vc.newReadSecretRequest(secretPath)
-	if resp, err := vc.client.Do(req); err != nil {
-		return nil, err
+// setNamespace sends req to namespace, a child of VAULT_NAMESPACE, or to
+// VAULT_NAMESPACE itself when namespace is "".
+func (vc VaultClient) setNamespace(req *http.Request, namespace string) {
+	if namespace = vc.joinNamespace(namespace); namespace != "" {
+		req.Header.Set(vaultNamespaceHeader, namespace)
 	} else {
-		body, err := ioutil.ReadAll(resp.Body)
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				log.Printf("WARN: error closing read request response body: %s\n", err.Error())
-			}
-		}()
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf("FetchSecret() failed reading auth request response body: %s\n", err.Error()))
+		req.Header.Del(vaultNamespaceHeader)
+	}
+}
+
+func (vc VaultClient) newReadSecretRequest(secretPath string) *http.Request {
+	return vc.newRequest("GET", secretPath, nil)
+}
+
+func (vc VaultClient) auth(method authMethod) (int, []byte, error) {
+	req, err := vc.newAuthRequest(method)
+	if err != nil {
+		return 0, nil, err
+	}
+	return vc.do(req)
+}
+
+// do sends req, built by newRequest, to the current Vault node and returns
+// the status code and body of the response. When the node can't be reached
+// or answers with a server error, the request is sent again straight away to
+// the next healthy node. Once every node has failed it, the request is
+// retried after a backoff, starting another round from the node it last
+// went to; the retries and the deadline are shared by all the nodes.
+func (vc VaultClient) do(req *http.Request) (int, []byte, error) {
+	apiURL := *req.URL
+	address := vc.nodes.address()
+	tried := map[string]bool{address.String(): true}
+	req.URL = nodeURL(address, &apiURL)
+
+	return vc.client.doWithFailover(req, func(req *http.Request, reason string) bool {
+		next := vc.nodes.failover(address, tried)
+		if next == nil {
+			tried = map[string]bool{address.String(): true}
+			return false
+		}
+		log.Printf("WARN: request to Vault node %s failed (%s), failing over to %s", address, reason, next)
+		address = next
+		tried[address.String()] = true
+		req.URL = nodeURL(address, &apiURL)
+		return true
+	})
+}
+
+// send sends req to the node its URL points at, retrying transient failures.
+func (vc VaultClient) send(req *http.Request) (int, []byte, error) {
+	return vc.client.do(req)
+}
+
+// readSecret resolves the mount serving secretPath, reads it from the path
+// the engine expects and parses the response for the engine's KV version.
+// When the mount can't be resolved, the path is read as given and parsed
+// according to VAULT_KV_VERSION. A version above 0 pins the read to that KV
+// v2 version. namespace is relative to VAULT_NAMESPACE.
+func (vc VaultClient) readSecret(namespace, secretPath string, version int) (VaultReadResponse, error) {
+	kvVersion := vc.BackendVersion
+	logicalPath := secretPath
+
+	if mount, err := vc.lookupMount(namespace, secretPath); err != nil {
+		if debugMode {
+			log.Printf("DEBUG: falling back to VAULT_KV_VERSION for '%s': %s", secretPath, err.Error())
 		}
-		if resp.StatusCode != 200 {
-			return nil, vaultSecretFetcherError{fmt.Sprintf("FetchSecret() failed to fetch '%s' - Response code: %d", secretPath, resp.StatusCode)}
+	} else {
+		logicalPath = mount.logicalPath(secretPath)
+		kvVersion = "1"
+		if mount.isKVv2() {
+			kvVersion = "2"
+		}
+	}
+
+	req := vc.newReadSecretRequest(logicalPath)
+	vc.setNamespace(req, namespace)
+	if version > 0 {
+		if kvVersion != "2" {
+			return nil, vaultSecretFetcherError{fmt.Sprintf("FetchSecret() can't read version %d of '%s': versions are only supported on KV v2 mounts", version, secretPath)}
 		}
-		if vc.BackendVersion == "" || vc.BackendVersion == "1" {
-			return NewVaultV1Response([]byte(body))
-		} else if vc.BackendVersion == "2" {
-			return NewVaultV2Response([]byte(body))
-		} else {
-			return nil, errors.New(fmt.Sprintf("received invalid kv version of: %s", vc.BackendVersion))
+		req.URL.RawQuery = url.Values{"version": {strconv.Itoa(version)}}.Encode()
+	}
+
+	status, body, err := vc.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if kvVersion == "2" && (status == 200 || status == 404) {
+		if err := checkV2Deletion(secretPath, version, status, body); err != nil {
+			return nil, err
 		}
 	}
+	if status == 404 {
+		return nil, NewSecretNotFoundError(fmt.Sprintf("FetchSecret() found no secret at '%s' - Response code: %d", logicalPath, status))
+	}
+	if status != 200 {
+		return nil, NewVaultStatusError(fmt.Sprintf("FetchSecret() failed to fetch '%s' - Response code: %d", logicalPath, status), status)
+	}
+	if kvVersion == "" || kvVersion == "1" {
+		return NewVaultV1Response(body)
+	} else if kvVersion == "2" {
+		return NewVaultV2Response(body)
+	} else {
+		return nil, errors.New(fmt.Sprintf("received invalid kv version of: %s", kvVersion))
+	}
 }
 
-func (vc VaultClient) LogString() string {
-	return vc.client.LogString()
+// checkV2Deletion turns the metadata KV v2 returns for a soft-deleted or
+// destroyed version into an error. Vault answers such reads with a 404 that
+// still carries the version's metadata, which is otherwise indistinguishable
+// from a path that doesn't exist. A 200 only counts as deleted when it holds
+// no data: with delete_version_after, every live version carries a
+// deletion_time in the future.
+func checkV2Deletion(secretPath string, version int, status int, body []byte) error {
+	var resp VaultV2Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+
+	metadata := resp.Data.Metadata
+	if !metadata.Destroyed && metadata.DeletionTime == "" {
+		return nil
+	}
+	if status != 404 {
+		if resp.Data.Data != nil {
+			return nil
+		}
+		if !metadata.Destroyed {
+			deletionTime, err := time.Parse(time.RFC3339Nano, metadata.DeletionTime)
+			if err != nil || deletionTime.After(time.Now()) {
+				return nil
+			}
+		}
+	}
+
+	description := "the latest version"
+	if version > 0 {
+		description = fmt.Sprintf("version %d", version)
+	} else if metadata.Version > 0 {
+		description = fmt.Sprintf("the latest version (%d)", metadata.Version)
+	}
+	if metadata.Destroyed {
+		return NewSecretNotFoundError(fmt.Sprintf("%s of '%s' has been destroyed", description, secretPath))
+	}
+	return NewSecretNotFoundError(fmt.Sprintf("%s of '%s' was deleted at %s", description, secretPath, metadata.DeletionTime))
 }
 
 func (vc *VaultClient) SetToken(token string) {
-	vc.token = token
+	vc.token.set(token)
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckV2Deletion(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	tests := []struct {
+		name    string
+		version int
+		status  int
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "404 for a soft-deleted version",
+			status:  404,
+			body:    `{"data":{"data":null,"metadata":{"created_time":"2024-05-01T11:00:00.5Z","deletion_time":"2024-05-01T12:00:00.123456Z","destroyed":false,"version":3}}}`,
+			wantErr: "the latest version (3) of 'kv/app/db' was deleted at 2024-05-01T12:00:00.123456Z",
+		},
+		{
+			name:    "404 for a pinned soft-deleted version",
+			version: 2,
+			status:  404,
+			body:    `{"data":{"data":null,"metadata":{"deletion_time":"2024-05-01T12:00:00Z","destroyed":false,"version":2}}}`,
+			wantErr: "version 2 of 'kv/app/db' was deleted at 2024-05-01T12:00:00Z",
+		},
+		{
+			name:    "404 for a destroyed version",
+			status:  404,
+			body:    `{"data":{"data":null,"metadata":{"deletion_time":"","destroyed":true,"version":4}}}`,
+			wantErr: "the latest version (4) of 'kv/app/db' has been destroyed",
+		},
+		{
+			name:   "200 with a future deletion_time",
+			status: 200,
+			body:   fmt.Sprintf(`{"data":{"data":{"password":"s3cr3t"},"metadata":{"deletion_time":"%s","destroyed":false,"version":5}}}`, future),
+		},
+		{
+			name:   "200 without data and a future deletion_time",
+			status: 200,
+			body:   fmt.Sprintf(`{"data":{"data":null,"metadata":{"deletion_time":"%s","destroyed":false,"version":5}}}`, future),
+		},
+		{
+			name:    "200 without data and a past deletion_time",
+			status:  200,
+			body:    `{"data":{"data":null,"metadata":{"deletion_time":"2024-05-01T12:00:00Z","destroyed":false,"version":5}}}`,
+			wantErr: "was deleted at 2024-05-01T12:00:00Z",
+		},
+		{
+			name:   "200 for a live version",
+			status: 200,
+			body:   `{"data":{"data":{"password":"s3cr3t"},"metadata":{"deletion_time":"","destroyed":false,"version":5}}}`,
+		},
+		{
+			name:   "plain 404 without metadata",
+			status: 404,
+			body:   `{"errors":[]}`,
+		},
+		{
+			name:   "404 without a body",
+			status: 404,
+			body:   ``,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkV2Deletion("kv/app/db", tt.version, tt.status, []byte(tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkV2Deletion() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkV2Deletion() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if !isMissing(err) {
+				t.Errorf("checkV2Deletion() error is a %T, want a SecretNotFoundError", err)
+			}
+		})
+	}
+}
+
+func TestReadSecretDeleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "soft-deleted",
+			body:    `{"data":{"data":null,"metadata":{"deletion_time":"2024-05-01T12:00:00Z","destroyed":false,"version":3}}}`,
+			wantErr: "the latest version (3) of 'kv/app/db' was deleted at 2024-05-01T12:00:00Z",
+		},
+		{
+			name:    "destroyed",
+			body:    `{"data":{"data":null,"metadata":{"deletion_time":"","destroyed":true,"version":3}}}`,
+			wantErr: "the latest version (3) of 'kv/app/db' has been destroyed",
+		},
+		{
+			name:    "missing",
+			body:    `{"errors":[]}`,
+			wantErr: "found no secret at 'kv/data/app/db' - Response code: 404",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/v1/"+mountLookupPath) {
+					fmt.Fprint(w, `{"data":{"path":"kv/","type":"kv","options":{"version":"2"}}}`)
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer vault.Close()
+			vc := newTestVaultClient(vault)
+
+			_, err := vc.readSecret("", "kv/app/db", 0)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("readSecret() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if !isMissing(err) {
+				t.Errorf("readSecret() error is a %T, want a SecretNotFoundError", err)
+			}
+		})
+	}
+}
+
+func TestSetNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    string
+		namespace string
+		want      string
+	}{
+		{name: "neither", want: ""},
+		{name: "VAULT_NAMESPACE only", parent: "team-a", want: "team-a"},
+		{name: "child only", namespace: "app", want: "app"},
+		{name: "child of VAULT_NAMESPACE", parent: "team-a", namespace: "app", want: "team-a/app"},
+		{name: "nested", parent: "org/team-a", namespace: "app/dev", want: "org/team-a/app/dev"},
+		{name: "slashes around VAULT_NAMESPACE", parent: "/org/team-a/", namespace: "app", want: "org/team-a/app"},
+		{name: "slashes around the child", parent: "team-a", namespace: "/app/", want: "team-a/app"},
+		{name: "slashes only", parent: "/", namespace: "/", want: ""},
+		{name: "empty child", parent: "team-a/", namespace: "", want: "team-a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := VaultClient{namespace: tt.parent, token: &vaultToken{}}
+			if got := vc.joinNamespace(tt.namespace); got != tt.want {
+				t.Errorf("joinNamespace(%q) = %q, want %q", tt.namespace, got, tt.want)
+			}
+
+			// The header set by newRequest for VAULT_NAMESPACE is replaced,
+			// or removed when there is no namespace at all.
+			req := vc.newRequest("GET", "kv/app", nil)
+			req.Header.Set(vaultNamespaceHeader, "stale")
+			vc.setNamespace(req, tt.namespace)
+			if values := req.Header.Values(vaultNamespaceHeader); tt.want == "" && len(values) != 0 {
+				t.Errorf("%s = %q, want no header", vaultNamespaceHeader, values)
+			} else if tt.want != "" && (len(values) != 1 || values[0] != tt.want) {
+				t.Errorf("%s = %q, want %q", vaultNamespaceHeader, values, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSecretNamespace(t *testing.T) {
+	var headers []string
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.URL.Path+" "+r.Header.Get(vaultNamespaceHeader))
+		if strings.HasPrefix(r.URL.Path, "/v1/"+mountLookupPath) {
+			fmt.Fprint(w, `{"data":{"path":"kv/","type":"kv","options":{"version":"2"}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"data":{"password":"secret"},"metadata":{"version":1}}}`)
+	}))
+	defer vault.Close()
+	vc := newTestVaultClient(vault)
+	vc.namespace = "/team-a/"
+
+	if _, err := vc.readSecret("/app/", "kv/db", 0); err != nil {
+		t.Fatalf("readSecret() error = %v", err)
+	}
+	want := []string{"/v1/" + mountLookupPath + "kv/db team-a/app", "/v1/kv/data/db team-a/app"}
+	if strings.Join(headers, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", headers, want)
+	}
+}
+
+// fakeFailoverNode starts a healthy Vault node of cluster c1 that answers
+// everything but health checks with respond, and counts those requests.
+func fakeFailoverNode(t *testing.T, respond func(int, http.ResponseWriter)) (*httptest.Server, *countingServer) {
+	t.Helper()
+	counter := &countingServer{respond: respond}
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"initialized":true,"cluster_id":"c1"}`)
+	})
+	mux.Handle("/", counter)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, counter
+}
+
+func TestVaultClientDoFailover(t *testing.T) {
+	sleep := func(d time.Duration) func(int, http.ResponseWriter) {
+		return func(int, http.ResponseWriter) { time.Sleep(d) }
+	}
+	tests := []struct {
+		name         string
+		nodes        []func(int, http.ResponseWriter)
+		refused      bool
+		timeout      time.Duration
+		deadline     time.Duration
+		wantStatus   int
+		wantErr      string
+		wantAttempts []int
+	}{
+		{
+			name:         "first node sealed",
+			nodes:        []func(int, http.ResponseWriter){statuses(503), statuses(200)},
+			wantStatus:   200,
+			wantAttempts: []int{1, 1},
+		},
+		{
+			name:         "first node refusing connections",
+			nodes:        []func(int, http.ResponseWriter){statuses(200), statuses(200)},
+			refused:      true,
+			wantStatus:   200,
+			wantAttempts: []int{0, 1},
+		},
+		{
+			name:         "first node timing out",
+			nodes:        []func(int, http.ResponseWriter){sleep(300 * time.Millisecond), statuses(200)},
+			timeout:      100 * time.Millisecond,
+			wantStatus:   200,
+			wantAttempts: []int{1, 1},
+		},
+		{
+			name:         "every node sealed",
+			nodes:        []func(int, http.ResponseWriter){statuses(503), statuses(503), statuses(503)},
+			wantStatus:   503,
+			wantAttempts: []int{3, 3, 3},
+		},
+		{
+			name:         "sealed node unsealed on the retry",
+			nodes:        []func(int, http.ResponseWriter){statuses(503), statuses(503, 200), statuses(503)},
+			wantStatus:   200,
+			wantAttempts: []int{2, 2, 2},
+		},
+		{
+			name:         "rate limited on the current node",
+			nodes:        []func(int, http.ResponseWriter){statuses(429, 200), statuses(200)},
+			wantStatus:   200,
+			wantAttempts: []int{2, 0},
+		},
+		{
+			name:         "not found",
+			nodes:        []func(int, http.ResponseWriter){statuses(404), statuses(200)},
+			wantStatus:   404,
+			wantAttempts: []int{1, 0},
+		},
+		{
+			name:         "deadline shared by the nodes",
+			nodes:        []func(int, http.ResponseWriter){sleep(400 * time.Millisecond), statuses(200)},
+			deadline:     200 * time.Millisecond,
+			wantErr:      "VAULT_RETRY_DEADLINE=200ms passed",
+			wantAttempts: []int{1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses := []string{}
+			counters := []*countingServer{}
+			for _, respond := range tt.nodes {
+				server, counter := fakeFailoverNode(t, respond)
+				addresses = append(addresses, server.URL)
+				counters = append(counters, counter)
+			}
+			if tt.refused {
+				refused := httptest.NewServer(http.NotFoundHandler())
+				refused.Close()
+				addresses[0] = refused.URL
+			}
+			policy := testRetryPolicy()
+			if tt.timeout > 0 {
+				policy.timeout = tt.timeout
+			}
+			policy.deadline = tt.deadline
+			vc := VaultClient{
+				nodes:  newVaultNodes(strings.Join(addresses, ","), http.DefaultClient),
+				client: newRetryClient(http.DefaultClient, policy),
+				token:  &vaultToken{},
+			}
+
+			status, _, err := vc.do(vc.newRequest("GET", "kv/data/app", nil))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("do() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("do() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("do() status = %d, want %d", status, tt.wantStatus)
+			}
+			for i, counter := range counters {
+				if got := counter.count(); got != tt.wantAttempts[i] {
+					t.Errorf("node %d got %d attempt(s), want %d", i+1, got, tt.wantAttempts[i])
+				}
+			}
+		})
+	}
+}
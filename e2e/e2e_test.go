@@ -27,6 +27,10 @@ var secrets = []Secret{
 	{Path: "secrets/d", Key: "secret", Value: "valueD", Env: "SECRET_D", Version: 2},
 	{Path: "secrets/e", Key: "key1", Value: "valueE", Env: "SECRET_E", Version: 2},
 	{Path: "secrets/f", Key: "key2", Value: "valueF", Env: "SECRET_F", Version: 2},
+	// The dev server mounts `secret/` as KV v2; the fetcher detects it and
+	// reads from `secret/data/...` without the prefix in the reference.
+	{Path: "secret/g", Key: "secret", Value: "valueG", Env: "SECRET_G", Version: 1},
+	{Path: "secret/h", Key: "key1", Value: "valueH", Env: "SECRET_H", Version: 2},
 }
 
 type Config struct {
@@ -111,3 +115,17 @@ func TestVSFMatcherV2(t *testing.T) {
 		})
 	}
 }
+
+func TestVSFMatcherV2OptionalSecrets(t *testing.T) {
+	testContext.withDependencies(t, Vault, AppWithV2Matcher)
+	stdout, err := k8s.RunKubectlAndGetOutputE(t, testContext.KubectlOptions, "exec", "app-with-matcher-v2", "--", "/bin/sh", "-c", "cat /tmp/env")
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "OPTIONAL_WITH_DEFAULT=fallback"; !strings.Contains(stdout, want) {
+		t.Errorf("MatcherV2 = %v, want %v", stdout, want)
+	}
+	if unwanted := "OPTIONAL_WITHOUT_DEFAULT="; strings.Contains(stdout, unwanted) {
+		t.Errorf("MatcherV2 = %v, want no %v", stdout, unwanted)
+	}
+}
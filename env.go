@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// entrypointEnv is the environment the entrypoint starts with. Secrets are
+// set in it rather than in the fetcher's own environment, which the auth
+// methods read again when the fetcher logs in again in supervisor mode;
+// dynamic AWS credentials there would otherwise be taken for the workload's
+// own.
+type entrypointEnv map[string]string
+
+// newEntrypointEnv returns a copy of the fetcher's environment.
+func newEntrypointEnv() entrypointEnv {
+	env := entrypointEnv{}
+	for _, e := range os.Environ() {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
+
+func (env entrypointEnv) set(name, value string) {
+	env[name] = value
+}
+
+func (env entrypointEnv) unset(name string) {
+	delete(env, name)
+}
+
+// environ returns env in the `KEY=value` form of os.Environ.
+func (env entrypointEnv) environ() []string {
+	environ := make([]string, 0, len(env))
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
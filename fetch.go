@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	secretFetcherConcurrencyName = "FETCHER_CONCURRENCY"
+	defaultFetchConcurrency      = 8
+)
+
+// secretGroup holds the indices of every secret that reads the same Vault
+// path in the same namespace at the same version, or issues a secret from it
+// with the same parameters, so the path is requested once no matter how many
+// keys are taken from it.
+type secretGroup struct {
+	vaultNamespace string
+	path           string
+	version        int
+	params         map[string]interface{}
+	indices        []int
+	// currentVersion and dataHash identify what was last read from the
+	// path, so the watcher can tell when it changes. currentVersion is 0
+	// for paths that aren't on a KV v2 mount.
+	currentVersion int
+	dataHash       string
+	// lease is the lease of a dynamic secret, which the renewer keeps
+	// alive.
+	lease vaultLease
+}
+
+// secretGroupKey identifies a group; namespaces and paths may both contain
+// slashes, so they can't simply be joined into a string. params holds the
+// issue parameters as JSON, whose object keys are sorted.
+type secretGroupKey struct {
+	vaultNamespace string
+	path           string
+	version        int
+	params         string
+}
+
+func groupSecrets(secrets []Secret) []*secretGroup {
+	groups := []*secretGroup{}
+	byKey := map[secretGroupKey]*secretGroup{}
+
+	for i, secret := range secrets {
+		groupKey := secretGroupKey{
+			vaultNamespace: strings.Trim(secret.GetVaultNamespace(), "/"),
+			path:           secret.GetPath(),
+			version:        secret.GetKVVersion(),
+		}
+		var params map[string]interface{}
+		if dynamic := dynamicOf(secret); dynamic != nil && dynamic.params != nil {
+			params = dynamic.params
+			encoded, _ := json.Marshal(params)
+			groupKey.params = string(encoded)
+		}
+		group, ok := byKey[groupKey]
+		if !ok {
+			group = &secretGroup{vaultNamespace: groupKey.vaultNamespace, path: groupKey.path, version: groupKey.version, params: params}
+			byKey[groupKey] = group
+			groups = append(groups, group)
+		}
+		group.indices = append(group.indices, i)
+	}
+	return groups
+}
+
+func GetFetchConcurrency() int {
+	value, ok := os.LookupEnv(secretFetcherConcurrencyName)
+	if !ok {
+		return defaultFetchConcurrency
+	}
+
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		log.Fatalf("ERROR: %s must be a positive integer, got '%s'", secretFetcherConcurrencyName, value)
+	}
+	return concurrency
+}
+
+// FetchSecrets reads every distinct path referenced by secrets with at most
+// concurrency requests in flight and sets the value of each secret from the
+// response of its path. The returned errors are index-aligned with secrets
+// and hold the error, if any, for each of them; the groups are the paths that
+// were read.
+func FetchSecrets(secrets []Secret, concurrency int) ([]error, []*secretGroup) {
+	errs := make([]error, len(secrets))
+	groups := groupSecrets(secrets)
+	if len(groups) == 0 {
+		// Nothing to read, so the client isn't created here. Logging in has
+		// already created it unless VAULT_TOKEN was provided, in which case
+		// nothing else may need Vault's address.
+		return errs, groups
+	}
+
+	if concurrency > len(groups) {
+		concurrency = len(groups)
+	}
+
+	// The client is a lazily created singleton; create it before the
+	// workers start so they don't race on its initialisation.
+	client := NewVaultClient()
+
+	jobs := make(chan *secretGroup)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				fetchGroup(client, group, secrets, errs)
+			}
+		}()
+	}
+
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs, groups
+}
+
+// fetchGroup only writes to the indices owned by group, which are disjoint
+// between groups, so no locking is needed around errs.
+func fetchGroup(client *VaultClient, group *secretGroup, secrets []Secret, errs []error) {
+	resp, err := client.readGroup(group)
+	if err == nil {
+		group.currentVersion, group.dataHash = resp.GetVersion(), hashData(resp.GetData())
+		group.lease = resp.GetLease()
+	}
+	for _, i := range group.indices {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = extractSecret(resp, secrets[i])
+	}
+}
+
+// hasLeases reports whether any of groups read a dynamic secret.
+func hasLeases(groups []*secretGroup) bool {
+	for _, group := range groups {
+		if group.lease.ID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// readGroup reads the path of group, or issues a secret from it when group
+// has parameters.
+func (vc VaultClient) readGroup(group *secretGroup) (VaultReadResponse, error) {
+	if group.params != nil {
+		return vc.issueCertificate(group.vaultNamespace, group.path, group.params)
+	}
+	return vc.readSecret(group.vaultNamespace, group.path, group.version)
+}
+
+// extractSecret sets the value of secret from resp. The value is taken from
+// the secret's key, or from the whole secret when it has no key, and narrowed
+// down by its selector when it has one.
+func extractSecret(resp VaultReadResponse, secret Secret) error {
+	if dynamic := dynamicOf(secret); dynamic != nil {
+		if dynamic.Type == secretTypePKI {
+			return extractPKIFields(resp, dynamic)
+		}
+		return extractFields(resp, dynamic)
+	}
+
+	var value interface{} = map[string]interface{}(resp.GetData())
+
+	if secret.GetKey() != "" || secret.GetSelector() == "" {
+		var ok bool
+		if value, ok = resp.GetData()[secret.GetKey()]; !ok {
+			message := fmt.Sprintf("error extracting secret [%s] from response: no value for key: %s", secret.GetKey(), secret.GetKey())
+			return NewSecretNotFoundError(message)
+		}
+	}
+
+	if secret.GetSelector() != "" {
+		var err error
+		if value, err = selectValue(value, secret.GetSelector()); err != nil {
+			message := fmt.Sprintf("error extracting secret [%s] from response: %s", secret.GetKey(), err.Error())
+			if _, ok := err.(SecretNotFoundError); ok {
+				return NewSecretNotFoundError(message)
+			}
+			return errors.New(message)
+		}
+	}
+
+	secretStr, err := formatValue(value)
+	if err != nil {
+		message := fmt.Sprintf("error extracting secret [%s] from response: %s", secret.GetKey(), err.Error())
+		return errors.New(message)
+	}
+	secret.SetValue(secretStr)
+	return nil
+}
+
+// extractFields sets the fields a secret of a dynamic type takes from its
+// response, such as the username and password of database credentials, so
+// they all come from a single lease. Null fields are left out.
+func extractFields(resp VaultReadResponse, dynamic *dynamicSecret) error {
+	fields := map[string]string{}
+	for _, field := range dynamic.fieldNames() {
+		value, ok := resp.GetData()[field]
+		if !ok {
+			return fmt.Errorf("error extracting secret from response: no value for field: %s", field)
+		}
+		if value == nil {
+			continue
+		}
+		formatted, err := formatValue(value)
+		if err != nil {
+			return fmt.Errorf("error extracting secret from response: field %s: %s", field, err.Error())
+		}
+		fields[field] = formatted
+	}
+	dynamic.fields = fields
+	return nil
+}
+
+// isMissing reports whether err means the secret doesn't exist in Vault, in
+// which case an optional secret falls back to its default or is left unset.
+func isMissing(err error) bool {
+	_, ok := err.(SecretNotFoundError)
+	return ok
+}
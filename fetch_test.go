@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKVStore serves KV v2 secrets by path, counting the reads of each and
+// the most reads in flight at once. Paths it doesn't hold answer 404.
+type fakeKVStore struct {
+	sync.Mutex
+	secrets     map[string]string
+	reads       map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func (f *fakeKVStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v1/"+mountLookupPath) {
+		fmt.Fprint(w, `{"data":{"path":"kv/","type":"kv","options":{"version":"2"}}}`)
+		return
+	}
+	secretPath := "kv/" + strings.TrimPrefix(r.URL.Path, "/v1/kv/data/")
+
+	f.Lock()
+	f.reads[secretPath]++
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	data, ok := f.secrets[secretPath]
+	f.Unlock()
+
+	// Hold the request long enough for the others to pile up.
+	time.Sleep(20 * time.Millisecond)
+
+	f.Lock()
+	f.inFlight--
+	f.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[]}`)
+		return
+	}
+	fmt.Fprintf(w, `{"data":{"data":%s,"metadata":{"version":1}}}`, data)
+}
+
+// withVaultClient makes NewVaultClient return a client for server for the
+// duration of the test.
+func withVaultClient(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	vc := newTestVaultClient(server)
+	previous := vaultClient
+	vaultClient = &vc
+	t.Cleanup(func() { vaultClient = previous })
+}
+
+func TestFetchSecrets(t *testing.T) {
+	store := &fakeKVStore{
+		secrets: map[string]string{
+			"kv/app/db":    `{"user":"app","password":"s3cr3t","port":5432}`,
+			"kv/app/api":   `{"key":"k1"}`,
+			"kv/app/cache": `{"url":"redis://cache"}`,
+			"kv/app/queue": `{"url":"amqp://queue"}`,
+			"kv/app/mail":  `{"url":"smtp://mail"}`,
+		},
+		reads: map[string]int{},
+	}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	withVaultClient(t, server)
+
+	references := []struct {
+		varName   string
+		reference string
+		wantValue string
+		wantErr   string
+	}{
+		{"DB_USER", `{"path":"kv/app/db","key":"user"}`, "app", ""},
+		{"API_KEY", `{"path":"kv/app/api","key":"key"}`, "k1", ""},
+		{"DB_PASSWORD", `{"path":"kv/app/db","key":"password"}`, "s3cr3t", ""},
+		{"MISSING", `{"path":"kv/app/missing","key":"value"}`, "", "found no secret at 'kv/data/app/missing'"},
+		{"DB_PORT", `{"path":"kv/app/db","key":"port"}`, "5432", ""},
+		{"DB_HOST", `{"path":"kv/app/db","key":"host"}`, "", "no value for key: host"},
+		{"CACHE_URL", `{"path":"kv/app/cache","key":"url"}`, "redis://cache", ""},
+		{"QUEUE_URL", `{"path":"kv/app/queue","key":"url"}`, "amqp://queue", ""},
+		{"MAIL_URL", `{"path":"kv/app/mail","key":"url"}`, "smtp://mail", ""},
+	}
+	secrets := []Secret{}
+	for _, ref := range references {
+		secret, err := newV2Secret(ref.varName, []byte(ref.reference))
+		if err != nil {
+			t.Fatalf("newV2Secret(%s) error = %v", ref.varName, err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	concurrency := 3
+	errs, groups := FetchSecrets(secrets, concurrency)
+
+	if len(groups) != 6 {
+		t.Errorf("FetchSecrets() read %d group(s), want one per path (6)", len(groups))
+	}
+	for secretPath, reads := range store.reads {
+		if reads != 1 {
+			t.Errorf("'%s' was read %d times, want once", secretPath, reads)
+		}
+	}
+	if store.maxInFlight > concurrency {
+		t.Errorf("%d reads were in flight at once, want at most %d", store.maxInFlight, concurrency)
+	}
+	if store.maxInFlight < 2 {
+		t.Errorf("reads were never in flight at the same time")
+	}
+	for i, ref := range references {
+		if ref.wantErr != "" {
+			if errs[i] == nil || !strings.Contains(errs[i].Error(), ref.wantErr) {
+				t.Errorf("%s error = %v, want it to contain %q", ref.varName, errs[i], ref.wantErr)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("%s error = %v, want none", ref.varName, errs[i])
+			continue
+		}
+		if got := secrets[i].GetValue(); got != ref.wantValue {
+			t.Errorf("%s = %q, want %q", ref.varName, got, ref.wantValue)
+		}
+	}
+}
+
+func TestGroupSecrets(t *testing.T) {
+	references := []string{
+		`{"path":"kv/app/db","key":"user"}`,
+		`{"path":"kv/app/db","key":"password"}`,
+		`{"path":"kv/app/db","key":"password","version":2}`,
+		`{"path":"kv/app/db","key":"user","namespace":"/team-a/"}`,
+		`{"path":"kv/app/db","key":"password","namespace":"team-a"}`,
+	}
+	secrets := []Secret{}
+	for i, reference := range references {
+		secret, err := newV2Secret(fmt.Sprintf("VAR_%d", i), []byte(reference))
+		if err != nil {
+			t.Fatalf("newV2Secret() error = %v", err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	groups := groupSecrets(secrets)
+	want := [][]int{{0, 1}, {2}, {3, 4}}
+	if len(groups) != len(want) {
+		t.Fatalf("groupSecrets() = %d group(s), want %d", len(groups), len(want))
+	}
+	for i, group := range groups {
+		if fmt.Sprint(group.indices) != fmt.Sprint(want[i]) {
+			t.Errorf("group %d (%s@%d in '%s') = %v, want %v", i, group.path, group.version, group.vaultNamespace, group.indices, want[i])
+		}
+	}
+}
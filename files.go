@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// secretFiles are the files the fetcher wrote secrets to, which it must not
+// read back as its own credentials.
+var secretFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// isSecretFile reports whether path is a file the fetcher wrote secrets to.
+func isSecretFile(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+	return secretFiles.paths[absPath]
+}
+
+func addSecretFile(path string) {
+	if absPath, err := filepath.Abs(path); err == nil {
+		secretFiles.Lock()
+		secretFiles.paths[absPath] = true
+		secretFiles.Unlock()
+	}
+}
+
+// writeSecretFiles writes the secrets that go to files rather than the
+// environment.
+func writeSecretFiles(secrets []Secret) error {
+	if err := writeAWSCredentials(secrets); err != nil {
+		return err
+	}
+	if err := writeGCPKeys(secrets); err != nil {
+		return err
+	}
+	return writePKIFiles(secrets)
+}
+
+// writeFileAtomic writes data to path with perm by writing a temporary file
+// next to it and renaming it over path, so readers never see a partial file.
+// Missing parent directories are created, readable only by the owner.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Set the mode before writing, so the data is never readable by more
+	// than perm allows.
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
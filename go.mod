@@ -1,5 +1,3 @@
 module github.com/unity-technologies/vault-secret-fetcher
 
 go 1.15
-
-require github.com/sethgrid/pester v0.0.0-20180227223404-ed9870dad317
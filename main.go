@@ -1,8 +1,6 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -14,15 +12,14 @@ import (
 )
 
 const (
-	namespacePath                     = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
-	secretFetcherVersionName          = "FETCHER_FORMAT_VERSION"
-	secretFetcherDebugMode = "FETCHER_DEBUG"
-	PinnedCert = `-----BEGIN CERTIFICATE-----.-----END CERTIFICATE-----`
+	secretFetcherVersionName = "FETCHER_FORMAT_VERSION"
+	secretFetcherDebugMode   = "FETCHER_DEBUG"
 )
 
 var (
-	build string
-	debugMode = os.Getenv(secretFetcherDebugMode) == "true"
+	build         string
+	debugMode     = os.Getenv(secretFetcherDebugMode) == "true"
+	namespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 type vaultSecretFetcherError struct {
@@ -33,7 +30,7 @@ func (e vaultSecretFetcherError) Error() string {
 	return fmt.Sprintf("%s", e.msg)
 }
 
-func SysExec() {
+func SysExec(env entrypointEnv) {
 	flag.Parse()
 
 	cmd, err := exec.LookPath(os.Args[1])
@@ -41,7 +38,7 @@ func SysExec() {
 		log.Fatalf("Fatal error: SysExec() failed to locate the entrypoint '%s' - %s", os.Args[1], err)
 	}
 
-	if err := syscall.Exec(cmd, flag.Args(), os.Environ()); err != nil {
+	if err := syscall.Exec(cmd, flag.Args(), env.environ()); err != nil {
 		log.Fatalf("Fatal error: SysExec() failed to perform execv syscall - %s", err)
 	}
 }
@@ -89,65 +86,39 @@ func GetFormatVersion() string {
 	return SecretFormatV1
 }
 
-func Auth() {
+// Auth logs in to Vault and returns the auth method used and the lease of
+// the token it got.
+func Auth() (authMethod, vaultLease) {
 	client := NewVaultClient()
-	log.Printf("INFO: authenticating with endpoint '%s' using role %s", client.authURL, client.role)
-
-	resp, err := client.auth()
-	if err != nil {
-		log.Printf("%s", err)
-		log.Print(client.LogString())
-		os.Exit(1)
+	method := newAuthMethod()
+	if method.role() != "" {
+		log.Printf("INFO: authenticating with endpoint '%s' using %s auth and role %s", client.authURL(method), method.name(), method.role())
+	} else {
+		log.Printf("INFO: authenticating with endpoint '%s' using %s auth", client.authURL(method), method.name())
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Printf("WARN: error closing auth request response body: %s\n", err.Error())
-		}
-	}()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	lease, err := client.login(method)
 	if err != nil {
-		log.Fatalf("ERROR: Auth() failed reading auth request response body: %s\n", err.Error())
-	}
-	if resp.StatusCode != 200 {
-		log.Fatalf("ERROR: Auth() failed to authenticate with Vault - Response code: %d - %s", resp.StatusCode, body)
+		log.Fatalf("ERROR: Auth() %s", err.Error())
 	}
+	return method, lease
+}
 
-	var responseInterface map[string]interface{}
-	err = json.Unmarshal(body, &responseInterface)
-	if err != nil {
-		log.Fatalf("ERROR: Auth() failed to unmarshal JSON response: %s\n", err.Error())
-	}
-	token := responseInterface["auth"].(map[string]interface{})["client_token"]
-	if tokenStr, ok := token.(string); ok {
-		client.SetToken(tokenStr)
+// setSecretEnv sets the variables of secret in env: its own, or those a
+// dynamic secret sets, in which case its own reference is unset.
+func setSecretEnv(env entrypointEnv, secret Secret) {
+	dynamic := dynamicOf(secret)
+	if dynamic == nil {
+		env.set(secret.VarName(), secret.GetValue())
 		return
 	}
-
-	log.Fatal("Fatal error: Auth() failed to read token from authentication JSON response")
-}
-
-func FetchSecret(secret Secret) error {
-	var resp VaultReadResponse
-	var secretStr string
-	var err error
-
-	client := NewVaultClient()
-
-	if resp, err = client.readSecret(secret.GetPath()); err != nil {
-		return err
+	values := dynamic.environment()
+	for name, value := range values {
+		env.set(name, value)
 	}
-
-	if secretStr, err = resp.GetSecret(secret.GetKey()); err != nil {
-		message := fmt.Sprintf("error extracting secret [%s] from response: %s", secret.GetKey(), err.Error())
-		return errors.New(message)
+	if _, ok := values[secret.VarName()]; !ok {
+		env.unset(secret.VarName())
 	}
-	secret.SetValue(secretStr)
-	return nil
-}
-
-func SetSecretToEnvVar(varName, value string) error {
-	return os.Setenv(varName, value)
 }
 
 func main() {
@@ -172,14 +143,19 @@ func main() {
 	}
 
 	token := os.Getenv("VAULT_TOKEN")
-	if len(token) == 0 {
-		Auth()
+	tokenMinted := len(token) == 0
+	var method authMethod
+	var tokenLease vaultLease
+	if tokenMinted {
+		method, tokenLease = Auth()
 	} else {
 		log.Println("INFO: A VAULT_TOKEN has been provided. Will skip authentication and use the provided token")
 	}
 
 	secretFormat := GetFormatVersion()
 	matcher := NewMatcher(secretFormat)
+	report := newFetchReport()
+	secrets := []Secret{}
 	for _, e := range os.Environ() {
 		var secret Secret
 		var err error
@@ -190,27 +166,65 @@ func main() {
 				if debugMode {
 					log.Printf("DEBUG: %s", err.Error())
 				}
-				continue
 			default:
-				log.Fatalf("ERROR: %s", err.Error())
+				report.AddFormatError(strings.SplitN(e, "=", 2)[0], err)
 			}
+			continue
 		}
-		if err := FetchSecret(secret); err != nil {
-			log.Fatalf("ERROR: Failed to retrieve secret from %s::%s: %s", secret.GetPath(), secret.GetKey(), err.Error())
-		}
-		secretsFetched = secretsFetched + 1
-		if err := SetSecretToEnvVar(secret.VarName(), secret.GetValue()); err != nil {
-			message := fmt.Sprintf("ERROR: Failed to set %s in environment: %s", secret.VarName(), err.Error())
-			log.Fatalf(message)
+		secrets = append(secrets, secret)
+	}
+
+	errs, groups := FetchSecrets(secrets, GetFetchConcurrency())
+	env := newEntrypointEnv()
+	optionalMissing := 0
+	for i, secret := range secrets {
+		if errs[i] != nil {
+			if !secret.IsOptional() || !isMissing(errs[i]) {
+				report.AddFetchError(secret, errs[i])
+				continue
+			}
+			optionalMissing = optionalMissing + 1
+			defaultValue, ok := secret.GetDefault()
+			if !ok {
+				log.Printf("WARN: Optional secret %s is missing, leaving it unset: %s", secret.VarName(), errs[i].Error())
+				env.unset(secret.VarName())
+				continue
+			}
+			log.Printf("WARN: Optional secret %s is missing, using its default value: %s", secret.VarName(), errs[i].Error())
+			secret.SetValue(defaultValue)
+		} else {
+			secretsFetched = secretsFetched + 1
 		}
+		setSecretEnv(env, secret)
 	}
 
-	log.Printf("INFO: Secrets fetched: %d/%d", secretsFetched, matcher.ToFetch())
+	log.Printf("INFO: Secrets fetched: %d/%d (optional missing: %d)", secretsFetched, matcher.ToFetch(), optionalMissing)
 
-	if secretsFetched != matcher.ToFetch() {
+	if report.Len() > 0 {
+		log.Printf("ERROR: %s", report)
+	}
+	if report.Len() > 0 || secretsFetched+optionalMissing != matcher.ToFetch() {
 		log.Fatal("ERROR: Was not able to successfully fetch/set all secrets. Failing deployment")
 	}
+	if err := writeSecretFiles(secrets); err != nil {
+		log.Fatalf("ERROR: Failed to write secrets to files: %s", err.Error())
+	}
+
+	revokeToken := shouldRevokeToken(tokenMinted)
+	if getenvBool(secretFetcherSupervise) {
+		Supervise(env, newWatcher(secrets, groups), newRenewer(method, tokenLease, secrets, groups), revokeToken)
+	}
+	if os.Getenv(secretFetcherWatchInterval) != "" {
+		log.Printf("WARN: %s is ignored unless %s=true", secretFetcherWatchInterval, secretFetcherSupervise)
+	}
+	if revokeToken && hasLeases(groups) {
+		log.Printf("WARN: not revoking the Vault token, it would revoke the leases of the dynamic secrets with it")
+		revokeToken = false
+	}
+	if revokeToken {
+		RevokeToken()
+	}
 
 	// Equivalent to 'exec $@'.
-	SysExec()
+	SysExec(env)
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"regexp"
 	"strings"
 )
@@ -13,7 +17,9 @@ const (
 	v1CheckPattern       = "{{[\\s]*vault-secret ([a-zA-Z0-9_-]+\\/[a-zA-Z0-9\\/_-]+)[\\s]*}}$"
 	v1VaultSecretPattern = "{{[\\s]*vault-secret "
 	v1Key                = "secret"
-	v2SecretPattern      = `(?P<prefix>VAULTSECRET::)(?P<info>\{.*\})`
+	v2SecretPrefix       = "VAULTSECRET::"
+	v2SecretPattern      = v2SecretPrefix
+	secretTypeKV         = "kv"
 )
 
 // SecretFormatError is a custom error type.
@@ -46,12 +52,39 @@ func NewNoMatchError(varName string, matcherVersion string) NoMatchError {
 }
 
 func SecretPrinter(s Secret) string {
-	return fmt.Sprintf("<v%sSecret: %s:%s>", s.Version(), s.GetPath(), s.GetKey())
+	secretPath := s.GetPath()
+	if s.GetVaultNamespace() != "" {
+		secretPath = s.GetVaultNamespace() + "/" + secretPath
+	}
+	if dynamic := dynamicOf(s); dynamic != nil {
+		return fmt.Sprintf("<v%sSecret: %s %s>", s.Version(), dynamic.Type, secretPath)
+	}
+	if s.GetKVVersion() > 0 {
+		return fmt.Sprintf("<v%sSecret: %s@%d:%s>", s.Version(), secretPath, s.GetKVVersion(), s.GetKey())
+	}
+	return fmt.Sprintf("<v%sSecret: %s:%s>", s.Version(), secretPath, s.GetKey())
 }
 
 type Secret interface {
 	GetPath() string
 	GetKey() string
+	// GetKVVersion returns the KV v2 version the secret is pinned to, or 0
+	// for the latest version.
+	GetKVVersion() int
+	// GetSelector returns the JSON pointer or JSONPath used to pick a nested
+	// field out of the value, or "" to use the value as-is.
+	GetSelector() string
+	// IsOptional reports whether the secret may be missing from Vault.
+	IsOptional() bool
+	// GetDefault returns the value to use when an optional secret is
+	// missing, and whether the secret has one.
+	GetDefault() (string, bool)
+	// GetVaultNamespace returns the Vault namespace the secret is read
+	// from, relative to VAULT_NAMESPACE, or "" for VAULT_NAMESPACE itself.
+	GetVaultNamespace() string
+	// GetOnChange returns what to do when the secret changes in Vault while
+	// the entrypoint runs, or "" for the default set by FETCHER_ON_CHANGE.
+	GetOnChange() string
 	VarName() string
 	SetValue(string)
 	GetValue() string
@@ -83,6 +116,30 @@ func (s v1Secret) GetKey() string {
 	return s.key
 }
 
+func (s v1Secret) GetKVVersion() int {
+	return 0
+}
+
+func (s v1Secret) GetSelector() string {
+	return ""
+}
+
+func (s v1Secret) IsOptional() bool {
+	return false
+}
+
+func (s v1Secret) GetDefault() (string, bool) {
+	return "", false
+}
+
+func (s v1Secret) GetVaultNamespace() string {
+	return ""
+}
+
+func (s v1Secret) GetOnChange() string {
+	return ""
+}
+
 func (s v1Secret) VarName() string {
 	return s.varName
 }
@@ -123,7 +180,7 @@ func NewV1Matcher() *V1Matcher {
 }
 
 func (m *V1Matcher) Match(str string) (Secret, error) {
-	envVarLine := strings.Split(str, "=")
+	envVarLine := strings.SplitN(str, "=", 2)
 	if m.vaultSecretRegex.MatchString(envVarLine[1]) {
 		m.toFetch++
 		if m.checkRegex.MatchString(envVarLine[1]) {
@@ -148,16 +205,38 @@ func (m V1Matcher) Version() string {
 }
 
 type v2Secret struct {
-	Path    string `json:"path"`
-	Key     string `json:"key"`
-	varName string
-	value   string
-	version string
+	Path      string  `json:"path"`
+	Key       string  `json:"key"`
+	KVVersion int     `json:"version"`
+	Select    string  `json:"select"`
+	Optional  bool    `json:"optional"`
+	Default   *string `json:"default"`
+	Namespace string  `json:"namespace"`
+	OnChange  string  `json:"on_change"`
+	varName   string
+	value     string
+	version   string
+	// dynamic holds the options of a reference to a dynamic secret; it is
+	// nil for a key of a KV secret.
+	dynamic *dynamicSecret
 }
 
 func newV2Secret(varName string, data []byte) (*v2Secret, error) {
-	secret := v2Secret{varName: varName, version: SecretFormatV2}
-	if err := json.Unmarshal(data, &secret); err != nil {
+	// Both are decoded together so that a field neither of them knows,
+	// like a misspelled option, is rejected rather than ignored.
+	var reference struct {
+		v2Secret
+		dynamicSecret
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&reference)
+	if err == nil {
+		if _, trailing := decoder.Token(); trailing != io.EOF {
+			err = errors.New("unexpected data after the reference")
+		}
+	}
+	if err != nil {
 		message := fmt.Sprintf(
 			"failed to parse SecretFormatV2 secret from '%s': %s",
 			string(data),
@@ -165,6 +244,58 @@ func newV2Secret(varName string, data []byte) (*v2Secret, error) {
 		)
 		return nil, NewSecretFormatError(message)
 	}
+	secret, dynamic := reference.v2Secret, reference.dynamicSecret
+	secret.varName, secret.version = varName, SecretFormatV2
+	if strings.Trim(secret.Path, "/") == "" {
+		return nil, NewSecretFormatError(fmt.Sprintf("invalid reference '%s': a path is required", string(data)))
+	}
+	switch dynamic.Type {
+	case "", secretTypeKV:
+		if dynamic.hasOptions() {
+			return nil, NewSecretFormatError(fmt.Sprintf("invalid reference for '%s': env, file, profile, dir, common_name, alt_names and ttl only apply to dynamic secret types", secret.Path))
+		}
+		// Without either, the value would be looked up under an empty key,
+		// which an optional secret takes for a missing one.
+		if secret.Key == "" && secret.Select == "" {
+			return nil, NewSecretFormatError(fmt.Sprintf("invalid reference for '%s': a key or select is required", secret.Path))
+		}
+	case secretTypeDatabase:
+		err = validateDatabaseSecret(&secret, &dynamic)
+	case secretTypeAWS:
+		err = validateAWSSecret(&secret, &dynamic)
+	case secretTypeGCP:
+		err = validateGCPSecret(&secret, &dynamic)
+	case secretTypePKI:
+		if err = validatePKISecret(&secret, &dynamic); err == nil {
+			dynamic.params = pkiParams(&dynamic)
+		}
+	default:
+		return nil, NewSecretFormatError(fmt.Sprintf("invalid type '%s' for '%s': must be kv, database, aws, gcp or pki", dynamic.Type, secret.Path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dynamic.Type != "" && dynamic.Type != secretTypeKV {
+		secret.dynamic = &dynamic
+	}
+	if secret.KVVersion < 0 {
+		message := fmt.Sprintf(
+			"invalid version %d for '%s': versions start at 1",
+			secret.KVVersion,
+			secret.Path,
+		)
+		return nil, NewSecretFormatError(message)
+	}
+	if secret.Select != "" {
+		if _, err := parseSelector(secret.Select); err != nil {
+			return nil, NewSecretFormatError(fmt.Sprintf("invalid select for '%s': %s", secret.Path, err.Error()))
+		}
+	}
+	if secret.OnChange != "" {
+		if _, err := parseChangeAction(secret.OnChange); err != nil {
+			return nil, NewSecretFormatError(fmt.Sprintf("invalid on_change for '%s': %s", secret.Path, err.Error()))
+		}
+	}
 	return &secret, nil
 }
 
@@ -176,6 +307,35 @@ func (s v2Secret) GetKey() string {
 	return s.Key
 }
 
+func (s v2Secret) GetKVVersion() int {
+	return s.KVVersion
+}
+
+func (s v2Secret) GetSelector() string {
+	return s.Select
+}
+
+// IsOptional reports whether the secret may be missing. A secret with a
+// default value is always optional.
+func (s v2Secret) IsOptional() bool {
+	return s.Optional || s.Default != nil
+}
+
+func (s v2Secret) GetDefault() (string, bool) {
+	if s.Default == nil {
+		return "", false
+	}
+	return *s.Default, true
+}
+
+func (s v2Secret) GetVaultNamespace() string {
+	return s.Namespace
+}
+
+func (s v2Secret) GetOnChange() string {
+	return s.OnChange
+}
+
 func (s v2Secret) VarName() string {
 	return s.varName
 }
@@ -210,10 +370,17 @@ func NewV2Matcher() *V2Matcher {
 }
 
 func (m *V2Matcher) Match(str string) (Secret, error) {
-	envVarLine := strings.Split(str, "=")
-	if m.secretRegex.MatchString(envVarLine[1]) {
+	envVarLine := strings.SplitN(str, "=", 2)
+	// Any value with the prefix is a reference, so that a malformed one is
+	// counted and reported rather than passed on as it is. As before, the
+	// prefix may appear anywhere in the value, and the whole value is
+	// replaced by the secret.
+	if loc := m.secretRegex.FindStringIndex(envVarLine[1]); loc != nil {
 		m.toFetch++
-		js := strings.Split(envVarLine[1], "::")[1]
+		if loc[0] > 0 {
+			log.Printf("WARN: %s contains %s after other text, which is discarded: the whole value is replaced by the secret", envVarLine[0], v2SecretPrefix)
+		}
+		js := envVarLine[1][loc[1]:]
 		return newV2Secret(envVarLine[0], []byte(js))
 	}
 	return nil, NewNoMatchError(envVarLine[0], m.version)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestV2MatcherMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantPath string
+		wantErr  string
+	}{
+		{name: "reference", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","key":"port"}`, wantPath: "kv/app/db"},
+		{name: "value containing =", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","key":"port","default":"a=b"}`, wantPath: "kv/app/db"},
+		{name: "missing brace", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db"`, wantErr: "format"},
+		{name: "not JSON", line: `DB_PORT=VAULTSECRET::kv/app/db`, wantErr: "format"},
+		{name: "empty reference", line: `DB_PORT=VAULTSECRET::`, wantErr: "format"},
+		{name: "no key or select", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","optional":true}`, wantErr: "format"},
+		{name: "select without key", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","select":"$.port"}`, wantPath: "kv/app/db"},
+		{name: "plain value", line: `DB_PORT=5432`, wantErr: "no match"},
+		{name: "prefix not at the start", line: `DB_PORT=see VAULTSECRET::{"path":"kv/app/db","key":"port"}`, wantPath: "kv/app/db"},
+		{name: "no path", line: `DB_PORT=VAULTSECRET::{"key":"port"}`, wantErr: "format"},
+		{name: "empty path", line: `DB_PORT=VAULTSECRET::{"path":"/","key":"port"}`, wantErr: "format"},
+		{name: "unknown field", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","key":"port","bogus":1}`, wantErr: "format"},
+		{name: "misspelled option", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","key":"port","optinal":true}`, wantErr: "format"},
+		{name: "dynamic option", line: `DB=VAULTSECRET::{"type":"database","path":"database/creds/app"}`, wantPath: "database/creds/app"},
+		{name: "trailing data", line: `DB_PORT=VAULTSECRET::{"path":"kv/app/db","key":"port"}}`, wantErr: "format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewV2Matcher()
+			secret, err := m.Match(tt.line)
+			wantToFetch := 1
+			switch err.(type) {
+			case nil:
+				if tt.wantErr != "" {
+					t.Fatalf("Match() = %v, want a %s error", secret, tt.wantErr)
+				}
+				if secret.GetPath() != tt.wantPath {
+					t.Errorf("Match() path = %q, want %q", secret.GetPath(), tt.wantPath)
+				}
+			case SecretFormatError:
+				if tt.wantErr != "format" {
+					t.Fatalf("Match() error = %v, want %s", err, tt.wantErr)
+				}
+			case NoMatchError:
+				if tt.wantErr != "no match" {
+					t.Fatalf("Match() error = %v, want %s", err, tt.wantErr)
+				}
+				wantToFetch = 0
+			default:
+				t.Fatalf("Match() error = %v of type %T", err, err)
+			}
+			if m.ToFetch() != wantToFetch {
+				t.Errorf("ToFetch() = %d, want %d", m.ToFetch(), wantToFetch)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	kvMountType      = "kv"
+	genericMountType = "generic"
+	mountLookupPath  = "sys/internal/ui/mounts/"
+)
+
+// mountInfo describes the secrets engine a path is served by.
+type mountInfo struct {
+	path    string
+	kind    string
+	version string
+}
+
+func (m mountInfo) isKVv2() bool {
+	return m.kind == kvMountType && m.version == "2"
+}
+
+// logicalPath rewrites a path as users write it (`kv/app/db`) into the path
+// the engine serves it on. KV v2 keeps its data under `<mount>/data/`; paths
+// that already carry the prefix are left alone so older references written
+// for VAULT_KV_VERSION=2 keep working.
+func (m mountInfo) logicalPath(secretPath string) string {
+	if !m.isKVv2() {
+		return secretPath
+	}
+	rest := strings.TrimPrefix(secretPath, m.path)
+	if strings.HasPrefix(rest, "data/") {
+		return secretPath
+	}
+	return m.path + "data/" + rest
+}
+
+// metadataPath returns the path of the KV v2 metadata of secretPath.
+func (m mountInfo) metadataPath(secretPath string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(secretPath, m.path), "data/")
+	return m.path + "metadata/" + rest
+}
+
+type mountLookupResponse struct {
+	Data struct {
+		Path    string            `json:"path"`
+		Type    string            `json:"type"`
+		Options map[string]string `json:"options"`
+	} `json:"data"`
+}
+
+// mountCache remembers the mount of every path resolved so far, per
+// namespace since each namespace has its own mount table. Concurrent lookups
+// of paths that start with the same segment, and so likely sit under the
+// same mount, wait for the first one to finish instead of repeating it;
+// lookups of other paths, and paths already resolved, don't wait.
+type mountCache struct {
+	sync.Mutex
+	mounts   map[string]map[string]mountInfo
+	inFlight map[string]chan struct{}
+}
+
+func newMountCache() *mountCache {
+	return &mountCache{mounts: map[string]map[string]mountInfo{}, inFlight: map[string]chan struct{}{}}
+}
+
+func (c *mountCache) find(namespace, secretPath string) (mountInfo, bool) {
+	var found mountInfo
+	var ok bool
+
+	for mountPath, mount := range c.mounts[namespace] {
+		if strings.HasPrefix(secretPath, mountPath) && len(mountPath) > len(found.path) {
+			found, ok = mount, true
+		}
+	}
+	return found, ok
+}
+
+func (c *mountCache) add(namespace string, mount mountInfo) {
+	if c.mounts[namespace] == nil {
+		c.mounts[namespace] = map[string]mountInfo{}
+	}
+	c.mounts[namespace][mount.path] = mount
+}
+
+// lookupKey returns the key of the in-flight lookup a lookup of secretPath
+// waits for: its namespace and its first segment, as the mount isn't known
+// until the lookup returns.
+func lookupKey(namespace, secretPath string) string {
+	return namespace + "\x00" + strings.SplitN(secretPath, "/", 2)[0]
+}
+
+func (vc VaultClient) lookupMount(namespace, secretPath string) (mountInfo, error) {
+	fullNamespace := vc.joinNamespace(namespace)
+	key := lookupKey(fullNamespace, secretPath)
+
+	for {
+		vc.mounts.Lock()
+		if mount, ok := vc.mounts.find(fullNamespace, secretPath); ok {
+			vc.mounts.Unlock()
+			return mount, nil
+		}
+		if wait, ok := vc.mounts.inFlight[key]; ok {
+			vc.mounts.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		vc.mounts.inFlight[key] = done
+		vc.mounts.Unlock()
+
+		mount, err := vc.requestMount(namespace, secretPath)
+
+		vc.mounts.Lock()
+		if err == nil {
+			vc.mounts.add(fullNamespace, mount)
+		}
+		delete(vc.mounts.inFlight, key)
+		vc.mounts.Unlock()
+		close(done)
+		return mount, err
+	}
+}
+
+// requestMount asks Vault which mount serves secretPath.
+func (vc VaultClient) requestMount(namespace, secretPath string) (mountInfo, error) {
+	req := vc.newReadSecretRequest(mountLookupPath + secretPath)
+	vc.setNamespace(req, namespace)
+	status, body, err := vc.do(req)
+	if err != nil {
+		return mountInfo{}, err
+	}
+	if status != 200 {
+		return mountInfo{}, vaultSecretFetcherError{fmt.Sprintf("mount lookup for '%s' failed - Response code: %d", secretPath, status)}
+	}
+
+	var resp mountLookupResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return mountInfo{}, fmt.Errorf("failed to unmarshal mount lookup response for '%s': %s", secretPath, err.Error())
+	}
+
+	if resp.Data.Path == "" {
+		return mountInfo{}, fmt.Errorf("mount lookup for '%s' returned no mount path", secretPath)
+	}
+
+	mount := mountInfo{path: resp.Data.Path, kind: resp.Data.Type, version: resp.Data.Options["version"]}
+	if mount.kind == genericMountType || (mount.kind == kvMountType && mount.version == "") {
+		mount.kind, mount.version = kvMountType, "1"
+	}
+	if debugMode {
+		log.Printf("DEBUG: '%s' is served by mount '%s' (type: %s, version: %s)", secretPath, mount.path, mount.kind, mount.version)
+	}
+	return mount, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMountTable answers mount lookups as if every top-level segment were a
+// KV v2 mount, counting the lookups of each. Lookups under `slow/` wait for
+// release.
+type fakeMountTable struct {
+	sync.Mutex
+	lookups map[string]int
+	probed  chan struct{}
+	release chan struct{}
+}
+
+func (f *fakeMountTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mount := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"+mountLookupPath), "/", 2)[0] + "/"
+	f.Lock()
+	f.lookups[mount]++
+	f.Unlock()
+	if mount == "slow/" {
+		close(f.probed)
+		<-f.release
+	}
+	fmt.Fprintf(w, `{"data":{"path":"%s","type":"kv","options":{"version":"2"}}}`, mount)
+}
+
+func newTestVaultClient(server *httptest.Server) VaultClient {
+	return VaultClient{
+		nodes:  newVaultNodes(server.URL, http.DefaultClient),
+		client: newRetryClient(http.DefaultClient, retryPolicy{timeout: time.Second}),
+		token:  &vaultToken{},
+		mounts: newMountCache(),
+	}
+}
+
+func TestLookupMountConcurrent(t *testing.T) {
+	table := &fakeMountTable{lookups: map[string]int{}}
+	server := httptest.NewServer(table)
+	defer server.Close()
+	vc := newTestVaultClient(server)
+
+	var wg sync.WaitGroup
+	for _, secretPath := range []string{"kv/a", "kv/b", "kv/c/d", "team/a", "team/b"} {
+		wg.Add(1)
+		go func(secretPath string) {
+			defer wg.Done()
+			mount, err := vc.lookupMount("", secretPath)
+			if err != nil {
+				t.Errorf("lookupMount(%s) error = %v", secretPath, err)
+				return
+			}
+			if want := strings.SplitN(secretPath, "/", 2)[0] + "/"; mount.path != want || !mount.isKVv2() {
+				t.Errorf("lookupMount(%s) = %+v, want KV v2 mount %s", secretPath, mount, want)
+			}
+		}(secretPath)
+	}
+	wg.Wait()
+
+	for mount, lookups := range table.lookups {
+		if lookups != 1 {
+			t.Errorf("mount %s was looked up %d times, want once", mount, lookups)
+		}
+	}
+}
+
+func TestLookupMountDoesNotWaitForOtherMounts(t *testing.T) {
+	table := &fakeMountTable{lookups: map[string]int{}, probed: make(chan struct{}), release: make(chan struct{})}
+	server := httptest.NewServer(table)
+	defer server.Close()
+	defer close(table.release)
+	vc := newTestVaultClient(server)
+
+	if _, err := vc.lookupMount("", "kv/a"); err != nil {
+		t.Fatalf("lookupMount(kv/a) error = %v", err)
+	}
+	go vc.lookupMount("", "slow/a")
+	<-table.probed
+
+	looked := make(chan struct{})
+	go func() {
+		vc.lookupMount("", "kv/b")
+		vc.lookupMount("", "other/a")
+		close(looked)
+	}()
+	select {
+	case <-looked:
+	case <-time.After(time.Second):
+		t.Fatal("lookupMount() waited for the lookup of another mount")
+	}
+}
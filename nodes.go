@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultAddrName = "VAULT_ADDR"
+	healthPath    = "/v1/sys/health"
+	healthTimeout = 5 * time.Second
+)
+
+// healthQuery makes standbys and performance standbys answer 200, since both
+// serve reads and forward anything else to the active node.
+var healthQuery = url.Values{"standbyok": {"true"}, "perfstandbyok": {"true"}}.Encode()
+
+type healthResponse struct {
+	Initialized        bool   `json:"initialized"`
+	Sealed             bool   `json:"sealed"`
+	Standby            bool   `json:"standby"`
+	PerformanceStandby bool   `json:"performance_standby"`
+	ClusterID          string `json:"cluster_id"`
+	ClusterName        string `json:"cluster_name"`
+}
+
+// vaultNodes holds the addresses listed in VAULT_ADDR and the one requests
+// currently go to. Every node is expected to belong to the same cluster, so
+// the token obtained from one of them is valid on all of them; a node that
+// reports another cluster is never failed over to.
+type vaultNodes struct {
+	sync.Mutex
+	addresses  []*url.URL
+	current    int
+	clusterID  string
+	httpClient *http.Client
+}
+
+// newVaultNodes parses a comma-separated list of Vault addresses.
+func newVaultNodes(value string, httpClient *http.Client) *vaultNodes {
+	nodes := &vaultNodes{httpClient: &http.Client{Transport: httpClient.Transport, Timeout: healthTimeout}}
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSuffix(strings.TrimSpace(address), "/")
+		if address == "" {
+			continue
+		}
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			log.Fatalf("ERROR: %s contains an invalid address '%s'; expected e.g. https://vault.example.com:8200", vaultAddrName, address)
+		}
+		nodes.addresses = append(nodes.addresses, parsed)
+	}
+	if len(nodes.addresses) == 0 {
+		log.Fatalf("ERROR: %s contains no addresses", vaultAddrName)
+	}
+	return nodes
+}
+
+// address returns the address requests currently go to.
+func (n *vaultNodes) address() *url.URL {
+	n.Lock()
+	defer n.Unlock()
+	return n.addresses[n.current]
+}
+
+// selectHealthy points requests at the first healthy node, in the order they
+// are listed. With a single address there is nothing to choose from, so it
+// isn't probed.
+func (n *vaultNodes) selectHealthy() {
+	if len(n.addresses) == 1 {
+		return
+	}
+	if next := n.failover(nil, map[string]bool{}); next != nil {
+		return
+	}
+	log.Printf("WARN: no healthy Vault node found in %s, using %s", vaultAddrName, n.address())
+}
+
+// failover moves requests off failed, a node a request just failed on, to the
+// next healthy node that hasn't been tried for that request yet. When another
+// request already moved away from failed, the current node is returned as is.
+// It returns nil when no node is left to try. The candidates are probed
+// without holding the lock, so requests to the current node aren't held up by
+// health checks of others.
+func (n *vaultNodes) failover(failed *url.URL, tried map[string]bool) *url.URL {
+	n.Lock()
+	start := n.current
+	current := n.addresses[start]
+	if failed != nil && current != failed && !tried[current.String()] {
+		n.Unlock()
+		return current
+	}
+	n.Unlock()
+
+	first := start
+	if failed != nil {
+		first = start + 1
+	}
+	for i := 0; i < len(n.addresses); i++ {
+		index := (first + i) % len(n.addresses)
+		address := n.addresses[index]
+		if tried[address.String()] {
+			continue
+		}
+		if err := n.checkHealth(address); err != nil {
+			tried[address.String()] = true
+			log.Printf("WARN: skipping Vault node %s: %s", address, err.Error())
+			continue
+		}
+		return n.moveTo(start, index, tried)
+	}
+	return nil
+}
+
+// moveTo points requests at the node at index, unless another request has
+// moved them off the node at start in the meantime to one this request hasn't
+// tried, in which case that node is kept.
+func (n *vaultNodes) moveTo(start, index int, tried map[string]bool) *url.URL {
+	n.Lock()
+	defer n.Unlock()
+
+	if current := n.addresses[n.current]; n.current != start && !tried[current.String()] {
+		return current
+	}
+	n.current = index
+	return n.addresses[index]
+}
+
+// checkHealth reports why address can't serve requests, or nil when it can.
+// The first healthy node seen fixes the cluster the other nodes must belong
+// to.
+func (n *vaultNodes) checkHealth(address *url.URL) error {
+	health, err := n.probe(address)
+	if err != nil {
+		return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if n.clusterID == "" {
+		n.clusterID = health.ClusterID
+	} else if health.ClusterID != "" && health.ClusterID != n.clusterID {
+		return fmt.Errorf("node belongs to cluster %s (%s), not %s", health.ClusterName, health.ClusterID, n.clusterID)
+	}
+	if debugMode {
+		log.Printf("DEBUG: Vault node %s is healthy (cluster: %s, standby: %t, performance standby: %t)", address, health.ClusterName, health.Standby, health.PerformanceStandby)
+	}
+	return nil
+}
+
+// probe queries the health endpoint of address.
+func (n *vaultNodes) probe(address *url.URL) (healthResponse, error) {
+	var health healthResponse
+
+	healthURL := *address
+	healthURL.Path = address.Path + healthPath
+	healthURL.RawQuery = healthQuery
+
+	resp, err := n.httpClient.Get(healthURL.String())
+	if err != nil {
+		return health, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return health, fmt.Errorf("failed reading health check response: %s", err.Error())
+	}
+	switch resp.StatusCode {
+	case 200:
+	case 472:
+		return health, fmt.Errorf("node is a disaster recovery secondary")
+	case 501:
+		return health, fmt.Errorf("node is not initialized")
+	case 503:
+		return health, fmt.Errorf("node is sealed")
+	default:
+		return health, fmt.Errorf("health check failed - Response code: %d", resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, &health); err != nil {
+		return health, fmt.Errorf("failed to unmarshal health check response: %s", err.Error())
+	}
+	return health, nil
+}
+
+// nodeURL resolves apiURL, the node-relative URL of a request, against the
+// node at address.
+func nodeURL(address *url.URL, apiURL *url.URL) *url.URL {
+	resolved := *address
+	resolved.Path = address.Path + apiURL.Path
+	resolved.RawPath = ""
+	resolved.RawQuery = apiURL.RawQuery
+	return &resolved
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVaultNode answers health checks with status and a response for
+// clusterID.
+func fakeVaultNode(status int, clusterID string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"initialized":true,"sealed":%t,"cluster_id":"%s","cluster_name":"%s"}`, status == 503, clusterID, clusterID)
+	}))
+}
+
+func TestVaultNodesFailover(t *testing.T) {
+	sealed := fakeVaultNode(503, "c1")
+	defer sealed.Close()
+	other := fakeVaultNode(200, "c2")
+	defer other.Close()
+	healthy := fakeVaultNode(200, "c1")
+	defer healthy.Close()
+	first := fakeVaultNode(200, "c1")
+	defer first.Close()
+
+	nodes := newVaultNodes(strings.Join([]string{first.URL, sealed.URL, other.URL, healthy.URL}, ","), http.DefaultClient)
+	nodes.selectHealthy()
+	if got := nodes.address().String(); got != first.URL {
+		t.Fatalf("selectHealthy() picked %s, want %s", got, first.URL)
+	}
+
+	tried := map[string]bool{first.URL: true}
+	if got := nodes.failover(nodes.address(), tried); got == nil || got.String() != healthy.URL {
+		t.Fatalf("failover() = %v, want %s", got, healthy.URL)
+	}
+	if got := nodes.address().String(); got != healthy.URL {
+		t.Errorf("address() = %s after failover, want %s", got, healthy.URL)
+	}
+	for _, skipped := range []string{sealed.URL, other.URL} {
+		if !tried[skipped] {
+			t.Errorf("failover() didn't mark %s as tried", skipped)
+		}
+	}
+
+	tried[healthy.URL] = true
+	if got := nodes.failover(nodes.address(), tried); got != nil {
+		t.Errorf("failover() = %s with every node tried, want nil", got)
+	}
+}
+
+func TestVaultNodesFailoverDoesNotBlockRequests(t *testing.T) {
+	probed, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(probed)
+		<-release
+		fmt.Fprint(w, `{"initialized":true,"cluster_id":"c1"}`)
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	nodes := newVaultNodes("http://127.0.0.1:1,"+slow.URL, http.DefaultClient)
+	failed := nodes.address()
+	go nodes.failover(failed, map[string]bool{failed.String(): true})
+	<-probed
+
+	addressed := make(chan struct{})
+	go func() {
+		nodes.address()
+		close(addressed)
+	}()
+	select {
+	case <-addressed:
+	case <-time.After(time.Second):
+		t.Fatal("address() blocked on the health check of another node")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// The standard library parses unencrypted PKCS#8 keys only, so encrypted
+// ones are decrypted here. Only PBES2 with PBKDF2 and AES-CBC is supported,
+// which is what `openssl pkcs8 -topk8` and, since OpenSSL 3,
+// `openssl rsa -aes256` produce.
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+var errIncorrectPassword = errors.New("incorrect password")
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts the DER of an `ENCRYPTED PRIVATE KEY` block and
+// returns the DER of the PKCS#8 key it holds.
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %s", err.Error())
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("malformed PBES2 parameters: %s", err.Error())
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("malformed PBKDF2 parameters: %s", err.Error())
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 function %s", kdf.PRF.Algorithm)
+	}
+	var keyLength int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLength = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s, only AES-CBC is supported", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLength {
+		return nil, fmt.Errorf("malformed PBKDF2 parameters: key length %d doesn't match the cipher", kdf.KeyLength)
+	}
+	if kdf.IterationCount < 1 {
+		return nil, errors.New("malformed PBKDF2 parameters: no iterations")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("malformed AES-CBC parameters")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted key: data is not a whole number of blocks")
+	}
+
+	block, err := aes.NewCipher(pbkdf2(password, kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// A wrong password shows as broken padding, or rarely as a key that
+	// doesn't parse afterwards.
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errIncorrectPassword
+	}
+	plain = plain[:len(plain)-padding]
+	var key asn1.RawValue
+	if rest, err := asn1.Unmarshal(plain, &key); err != nil || len(rest) > 0 {
+		return nil, errIncorrectPassword
+	}
+	return plain, nil
+}
+
+// pbkdf2 derives a key of keyLength bytes from password as specified in
+// RFC 8018, section 5.2.
+func pbkdf2(password, salt []byte, iterations, keyLength int, prf func() hash.Hash) []byte {
+	mac := hmac.New(prf, password)
+	key := []byte{}
+	for index := uint32(1); len(key) < keyLength; index++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, index)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
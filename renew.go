@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	secretFetcherLeaseStateFile = "FETCHER_LEASE_STATE_FILE"
+	renewLeasePath              = "sys/leases/renew"
+	revokeLeasePath             = "sys/leases/revoke"
+	// minRenewWait keeps a failing renewal from being retried in a tight
+	// loop as the lease runs out.
+	minRenewWait = 5 * time.Second
+)
+
+// vaultLease is how long a token or a dynamic secret is valid for. Tokens
+// have no lease ID.
+type vaultLease struct {
+	ID        string
+	Renewable bool
+	Duration  time.Duration
+}
+
+// trackedLease is a lease the renewer keeps alive, along with what it knows
+// of its state.
+type trackedLease struct {
+	vaultNamespace string
+	path           string
+	lease          vaultLease
+	// initialDuration is the TTL the lease was issued with; a renewal
+	// that returns less means the lease has reached its max TTL.
+	initialDuration time.Duration
+	lastRenewed     time.Time
+	expiresAt       time.Time
+	capped          bool
+	// retryIn is set when the last renewal failed.
+	retryIn time.Duration
+	// group is the path the lease was read from; when refreshable, the
+	// secrets read from it are written to files, which are rewritten with
+	// a new lease when this one can't be renewed any further.
+	group       *secretGroup
+	refreshable bool
+	// tokenExpiresAt is set once the token that read the lease has been
+	// replaced by logging in again: Vault revokes the lease when that
+	// token expires, however long the lease was renewed for.
+	tokenExpiresAt time.Time
+	// wake cuts the wait for the next renewal short.
+	wake chan struct{}
+}
+
+func newTrackedLease(namespace, path string, lease vaultLease) *trackedLease {
+	now := time.Now()
+	return &trackedLease{
+		vaultNamespace:  namespace,
+		path:            path,
+		lease:           lease,
+		initialDuration: lease.Duration,
+		lastRenewed:     now,
+		expiresAt:       now.Add(lease.Duration),
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+// renewed records the lease returned by a renewal and reports whether it
+// has been capped by the max TTL.
+func (t *trackedLease) renewed(lease vaultLease) bool {
+	now := time.Now()
+	t.lease.Renewable, t.lease.Duration = lease.Renewable, lease.Duration
+	t.lastRenewed, t.expiresAt = now, now.Add(lease.Duration)
+	if !t.tokenExpiresAt.IsZero() && t.expiresAt.After(t.tokenExpiresAt) {
+		t.expiresAt = t.tokenExpiresAt
+	}
+	t.capped = lease.Duration < t.initialDuration
+	t.retryIn = 0
+	return t.capped
+}
+
+// replaced records the lease of a secret that was read again.
+func (t *trackedLease) replaced(lease vaultLease) {
+	now := time.Now()
+	t.lease, t.initialDuration = lease, lease.Duration
+	t.lastRenewed, t.expiresAt = now, now.Add(lease.Duration)
+	t.capped, t.retryIn = false, 0
+	t.tokenExpiresAt = time.Time{}
+}
+
+// orphaned records that the token that read the lease, which expires at
+// tokenExpiresAt, has been replaced, and wakes the lease's renewal so that
+// it is read again with the new token, or stops once it expires.
+func (t *trackedLease) orphaned(tokenExpiresAt time.Time) {
+	t.tokenExpiresAt = tokenExpiresAt
+	if t.expiresAt.After(tokenExpiresAt) {
+		t.expiresAt = tokenExpiresAt
+	}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// expired reports whether the lease has run out.
+func (t *trackedLease) expired() bool {
+	return !time.Now().Before(t.expiresAt)
+}
+
+// failed schedules a failed renewal to be retried halfway through what is
+// left of the lease.
+func (t *trackedLease) failed() {
+	t.retryIn = time.Until(t.expiresAt) / 2
+	if t.retryIn < minRenewWait {
+		t.retryIn = minRenewWait
+	}
+}
+
+// nextRenewal returns how long to wait before renewing the lease: until two
+// thirds of its TTL have passed, but no later than it expires.
+func (t *trackedLease) nextRenewal() time.Duration {
+	wait := t.lease.Duration * 2 / 3
+	if t.retryIn > 0 {
+		wait = t.retryIn
+	}
+	if left := time.Until(t.expiresAt); wait > left {
+		wait = left
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// renewer keeps the token and the leases of dynamic secrets alive while the
+// entrypoint runs, and revokes the leases when it exits.
+type renewer struct {
+	sync.Mutex
+	client *VaultClient
+	// method logs in again when the token reaches its max TTL; it is nil
+	// when the token was provided with VAULT_TOKEN.
+	method authMethod
+	token  *trackedLease
+	leases []*trackedLease
+	// superseded are the leases of secrets that were read again, which
+	// are still valid until they expire or are revoked at shutdown.
+	superseded []*trackedLease
+	secrets    []Secret
+	stateFile  string
+	stopped    bool
+}
+
+// newRenewer returns a renewer for the token and for the leases of groups,
+// which were read for secrets. tokenLease is only known when the fetcher
+// logged in; a provided token is looked up instead.
+func newRenewer(method authMethod, tokenLease vaultLease, secrets []Secret, groups []*secretGroup) *renewer {
+	client := NewVaultClient()
+	if method == nil {
+		var err error
+		if tokenLease, err = client.lookupSelf(); err != nil {
+			log.Printf("WARN: failed to look up the provided token, it won't be renewed: %s", err.Error())
+		}
+	}
+
+	r := &renewer{
+		client:    client,
+		method:    method,
+		token:     newTrackedLease("", "token", tokenLease),
+		secrets:   secrets,
+		stateFile: GetenvSafe(secretFetcherLeaseStateFile, false),
+	}
+	for _, group := range groups {
+		// Issued certificates aren't leased, but expire all the same.
+		if group.lease.ID == "" && group.params == nil {
+			continue
+		}
+		lease := newTrackedLease(group.vaultNamespace, group.path, group.lease)
+		lease.group = group
+		for _, i := range group.indices {
+			if dynamic := dynamicOf(secrets[i]); dynamic != nil && dynamic.writesFiles() {
+				lease.refreshable = true
+			}
+		}
+		r.leases = append(r.leases, lease)
+	}
+	return r
+}
+
+// run renews the token and each lease in the background until shutdown.
+func (r *renewer) run() {
+	r.writeState()
+	if r.token.lease.Duration > 0 {
+		go r.keepToken()
+	}
+	for _, lease := range r.leases {
+		if lease.lease.Renewable || lease.refreshable {
+			go r.keepLease(lease)
+		} else {
+			log.Printf("WARN: the lease of '%s' can't be renewed and expires at %s", lease.path, lease.expiresAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// keepToken renews the token and logs in again once it reaches its max TTL
+// or can't be renewed, when the fetcher logged in itself.
+func (r *renewer) keepToken() {
+	for {
+		r.Lock()
+		wait := r.token.nextRenewal()
+		renewable, capped := r.token.lease.Renewable, r.token.capped
+		r.Unlock()
+		time.Sleep(wait)
+
+		var lease vaultLease
+		var err error
+		switch {
+		case (capped || !renewable) && r.method != nil:
+			log.Printf("INFO: token is reaching its max TTL, logging in to Vault again")
+			lease, err = r.client.login(r.method)
+			if err == nil {
+				r.Lock()
+				previousExpiry := r.token.expiresAt
+				r.token = newTrackedLease("", "token", lease)
+				expiring := 0
+				for _, secretLease := range r.leases {
+					secretLease.orphaned(previousExpiry)
+					if !secretLease.refreshable {
+						expiring++
+					}
+				}
+				r.Unlock()
+				r.writeState()
+				if expiring > 0 {
+					log.Printf("WARN: the leases of %d dynamic secret(s) set in the environment belong to the previous token and expire with it at %s", expiring, previousExpiry.Format(time.RFC3339))
+				}
+				continue
+			}
+		case capped || !renewable:
+			r.Lock()
+			expiresAt := r.token.expiresAt
+			r.Unlock()
+			log.Printf("WARN: the provided token can't be renewed any further and expires at %s", expiresAt.Format(time.RFC3339))
+			return
+		default:
+			lease, err = r.client.renewSelf()
+		}
+
+		r.Lock()
+		if r.stopped {
+			r.Unlock()
+			return
+		}
+		if err != nil && r.method != nil && isPermissionDenied(err) {
+			// Vault no longer accepts the token, so it is as good as
+			// expired: log in again straight away.
+			log.Printf("WARN: Vault rejected the token, logging in again: %s", err.Error())
+			r.token.lease.Renewable = false
+			r.token.expiresAt = time.Now()
+		} else if err != nil {
+			log.Printf("WARN: failed to keep the token alive: %s", err.Error())
+			r.token.failed()
+		} else if r.token.renewed(lease) && debugMode {
+			log.Printf("DEBUG: token renewal was capped to %s by its max TTL", lease.Duration)
+		}
+		r.Unlock()
+		r.writeState()
+	}
+}
+
+// isPermissionDenied reports whether Vault answered with a 403, which it
+// returns for a token that was revoked or has expired.
+func isPermissionDenied(err error) bool {
+	statusErr, ok := err.(VaultStatusError)
+	return ok && statusErr.StatusCode == 403
+}
+
+// keepLease renews a secret's lease until it reaches its max TTL, after
+// which the secret expires. Secrets written to files are read again instead,
+// as are those whose lease can't be renewed at all, and their files
+// rewritten before the lease expires.
+func (r *renewer) keepLease(lease *trackedLease) {
+	for {
+		r.Lock()
+		wait := lease.nextRenewal()
+		r.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-lease.wake:
+		}
+
+		r.Lock()
+		if !lease.refreshable && lease.expired() {
+			expiresAt := lease.expiresAt
+			r.Unlock()
+			log.Printf("WARN: the lease of '%s' expired at %s and is no longer renewed", lease.path, expiresAt.Format(time.RFC3339))
+			return
+		}
+		// A lease whose token was replaced is read again with the new one
+		// rather than left to be revoked with the old one.
+		refresh := lease.refreshable && (lease.capped || !lease.lease.Renewable || !lease.tokenExpiresAt.IsZero())
+		previousExpiry := lease.expiresAt
+		r.Unlock()
+
+		var newLease vaultLease
+		var err error
+		if refresh {
+			newLease, err = r.refresh(lease.group)
+		} else {
+			newLease, err = r.client.renewLease(lease.vaultNamespace, lease.lease.ID)
+		}
+
+		r.Lock()
+		if r.stopped {
+			r.Unlock()
+			if refresh && err == nil && newLease.ID != "" && lease.revocable() {
+				// Read while shutting down, after the leases were revoked.
+				r.revoke(lease.vaultNamespace, lease.path, newLease.ID)
+			}
+			return
+		}
+		if err != nil {
+			log.Printf("WARN: failed to renew the lease of '%s': %s", lease.path, err.Error())
+			lease.failed()
+			r.Unlock()
+			r.writeState()
+			continue
+		}
+		capped := false
+		if refresh {
+			previous := *lease
+			r.superseded = append(r.superseded, &previous)
+			lease.replaced(newLease)
+		} else {
+			capped = lease.renewed(newLease)
+		}
+		expiresAt := lease.expiresAt
+		r.Unlock()
+		r.writeState()
+
+		if refresh {
+			log.Printf("INFO: read '%s' again and rewrote its files, the previous credentials expire at %s", lease.path, previousExpiry.Format(time.RFC3339))
+		} else if !lease.refreshable && (capped || !newLease.Renewable) {
+			log.Printf("WARN: the lease of '%s' has reached its max TTL and expires at %s", lease.path, expiresAt.Format(time.RFC3339))
+			return
+		}
+	}
+}
+
+// refresh reads group again, rewrites the files of its secrets and returns
+// the new lease.
+func (r *renewer) refresh(group *secretGroup) (vaultLease, error) {
+	resp, err := r.client.readGroup(group)
+	if err != nil {
+		return vaultLease{}, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, i := range group.indices {
+		if err := extractSecret(resp, r.secrets[i]); err != nil {
+			return vaultLease{}, err
+		}
+	}
+	if err := writeSecretFiles(r.secrets); err != nil {
+		return vaultLease{}, err
+	}
+	return resp.GetLease(), nil
+}
+
+// revocable reports whether the lease is revoked at shutdown. Issued
+// certificates, which are leased when their role sets generate_lease, are
+// left to expire: revoking them would only grow the CRL.
+func (t *trackedLease) revocable() bool {
+	return t.lease.ID != "" && (t.group == nil || t.group.params == nil)
+}
+
+// shutdown stops renewing and revokes the leases of the dynamic secrets,
+// including those superseded by reading a secret again and not yet expired,
+// so credentials don't outlive the entrypoint.
+func (r *renewer) shutdown() {
+	r.Lock()
+	r.stopped = true
+	leases := []*trackedLease{}
+	for _, lease := range append(r.superseded, r.leases...) {
+		if lease.revocable() && time.Now().Before(lease.expiresAt) {
+			copied := *lease
+			leases = append(leases, &copied)
+		}
+	}
+	r.Unlock()
+
+	for _, lease := range leases {
+		r.revoke(lease.vaultNamespace, lease.path, lease.lease.ID)
+	}
+}
+
+// revoke revokes a lease with a single attempt, as nothing waits on it.
+func (r *renewer) revoke(namespace, path, leaseID string) {
+	once := *r.client
+	once.client = r.client.client.withoutRetries()
+	if err := once.revokeLease(namespace, leaseID); err != nil {
+		log.Printf("WARN: failed to revoke the lease of '%s': %s", path, err.Error())
+		return
+	}
+	log.Printf("INFO: revoked the lease of '%s'", path)
+}
+
+type leaseState struct {
+	Path        string    `json:"path"`
+	LeaseID     string    `json:"lease_id,omitempty"`
+	Renewable   bool      `json:"renewable"`
+	TTL         int       `json:"ttl"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	LastRenewed time.Time `json:"last_renewed"`
+}
+
+func (t *trackedLease) state() leaseState {
+	return leaseState{
+		Path:        t.path,
+		LeaseID:     t.lease.ID,
+		Renewable:   t.lease.Renewable,
+		TTL:         int(time.Until(t.expiresAt).Seconds()),
+		ExpiresAt:   t.expiresAt.UTC(),
+		LastRenewed: t.lastRenewed.UTC(),
+	}
+}
+
+// writeState writes the token's and leases' state to FETCHER_LEASE_STATE_FILE
+// for monitoring. It holds no token or secret.
+func (r *renewer) writeState() {
+	if r.stateFile == "" {
+		return
+	}
+
+	r.Lock()
+	state := struct {
+		Token  leaseState   `json:"token"`
+		Leases []leaseState `json:"leases"`
+	}{Token: r.token.state(), Leases: []leaseState{}}
+	for _, lease := range r.leases {
+		state.Leases = append(state.Leases, lease.state())
+	}
+	r.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("WARN: failed to encode the lease state: %s", err.Error())
+		return
+	}
+	if err := writeFileAtomic(r.stateFile, data, 0644); err != nil {
+		log.Printf("WARN: failed to write %s: %s", r.stateFile, err.Error())
+	}
+}
+
+// renewLease extends the lease of a dynamic secret read in namespace.
+func (vc VaultClient) renewLease(namespace, leaseID string) (vaultLease, error) {
+	payload, err := json.Marshal(map[string]string{"lease_id": leaseID})
+	if err != nil {
+		return vaultLease{}, err
+	}
+	req := vc.newRequest("PUT", renewLeasePath, payload)
+	vc.setNamespace(req, namespace)
+	status, body, err := vc.do(req)
+	if err != nil {
+		return vaultLease{}, err
+	}
+	if status != 200 {
+		return vaultLease{}, NewVaultStatusError(fmt.Sprintf("%s - Response code: %d - %s", renewLeasePath, status, body), status)
+	}
+
+	var resp VaultBaseResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vaultLease{}, fmt.Errorf("failed to unmarshal %s response: %s", renewLeasePath, err.Error())
+	}
+	return resp.GetLease(), nil
+}
+
+// revokeLease ends the lease of a dynamic secret read in namespace, which
+// makes Vault revoke the credentials behind it.
+func (vc VaultClient) revokeLease(namespace, leaseID string) error {
+	payload, err := json.Marshal(map[string]string{"lease_id": leaseID})
+	if err != nil {
+		return err
+	}
+	req := vc.newRequest("PUT", revokeLeasePath, payload)
+	vc.setNamespace(req, namespace)
+	status, body, err := vc.do(req)
+	if err != nil {
+		return err
+	}
+	if status != 200 && status != 204 {
+		return NewVaultStatusError(fmt.Sprintf("%s - Response code: %d - %s", revokeLeasePath, status, body), status)
+	}
+	return nil
+}
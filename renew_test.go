@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseVault answers requests with the response given for their path, and
+// records the body of each request.
+type fakeLeaseVault struct {
+	sync.Mutex
+	responses map[string]fakeResponse
+	bodies    map[string][]map[string]interface{}
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+func newFakeLeaseVault(responses map[string]fakeResponse) *fakeLeaseVault {
+	return &fakeLeaseVault{responses: responses, bodies: map[string][]map[string]interface{}{}}
+}
+
+func (f *fakeLeaseVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.Lock()
+	f.bodies[r.URL.Path] = append(f.bodies[r.URL.Path], body)
+	resp, ok := f.responses[r.URL.Path]
+	f.Unlock()
+
+	if !ok {
+		resp = fakeResponse{status: 404, body: `{"errors":[]}`}
+	}
+	w.WriteHeader(resp.status)
+	fmt.Fprint(w, resp.body)
+}
+
+func (f *fakeLeaseVault) count(path string) int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.bodies[path])
+}
+
+// field returns a field of the first request to path.
+func (f *fakeLeaseVault) field(path, name string) interface{} {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.bodies[path]) == 0 {
+		return nil
+	}
+	return f.bodies[path][0][name]
+}
+
+// testAuth logs in to `auth/test/login` with a fixed payload.
+type testAuth struct{}
+
+func (a testAuth) name() string      { return "test" }
+func (a testAuth) role() string      { return "app" }
+func (a testAuth) loginPath() string { return "auth/test/login" }
+func (a testAuth) payload(vc VaultClient) (map[string]string, error) {
+	return map[string]string{"role": "app"}, nil
+}
+
+func newTestRenewer(server *httptest.Server, method authMethod, tokenLease vaultLease) *renewer {
+	vc := newTestVaultClient(server)
+	vc.client = vc.client.withoutRetries()
+	return &renewer{client: &vc, method: method, token: newTrackedLease("", "token", tokenLease)}
+}
+
+// waitFor polls condition until it holds or a second has passed.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTrackedLeaseSchedule(t *testing.T) {
+	lease := newTrackedLease("", "database/creds/app", vaultLease{ID: "l1", Renewable: true, Duration: time.Hour})
+	if wait := lease.nextRenewal(); wait < 39*time.Minute || wait > 40*time.Minute {
+		t.Errorf("nextRenewal() = %s, want two thirds of the TTL", wait)
+	}
+
+	if lease.renewed(vaultLease{ID: "l1", Renewable: true, Duration: time.Hour}) {
+		t.Errorf("renewed() with the full TTL reports the lease as capped")
+	}
+	if lease.renewed(vaultLease{ID: "l1", Renewable: true, Duration: 10 * time.Minute}) != true || !lease.capped {
+		t.Errorf("renewed() with less than the initial TTL doesn't report the lease as capped")
+	}
+	if left := time.Until(lease.expiresAt); left > 10*time.Minute || left < 9*time.Minute {
+		t.Errorf("capped lease expires in %s, want 10m", left)
+	}
+
+	lease.failed()
+	if wait := lease.nextRenewal(); wait < 4*time.Minute || wait > 5*time.Minute {
+		t.Errorf("nextRenewal() after a failure = %s, want half of what is left", wait)
+	}
+
+	lease.expiresAt = time.Now().Add(time.Second)
+	lease.failed()
+	if wait := lease.nextRenewal(); wait > time.Second {
+		t.Errorf("nextRenewal() = %s, want no later than the lease expires", wait)
+	}
+
+	tokenExpiresAt := time.Now().Add(time.Minute)
+	lease = newTrackedLease("", "database/creds/app", vaultLease{ID: "l1", Renewable: true, Duration: time.Hour})
+	lease.orphaned(tokenExpiresAt)
+	lease.renewed(vaultLease{ID: "l1", Renewable: true, Duration: time.Hour})
+	if !lease.expiresAt.Equal(tokenExpiresAt) {
+		t.Errorf("orphaned lease expires at %s, want the old token's expiry %s", lease.expiresAt, tokenExpiresAt)
+	}
+}
+
+func TestKeepLease(t *testing.T) {
+	tests := []struct {
+		name       string
+		renewal    string
+		wantCapped bool
+		wantTTL    time.Duration
+	}{
+		{
+			name:    "renewed for the full TTL",
+			renewal: `{"lease_id":"database/creds/app/l1","renewable":true,"lease_duration":3600}`,
+			wantTTL: time.Hour,
+		},
+		{
+			name:       "capped by max_ttl",
+			renewal:    `{"lease_id":"database/creds/app/l1","renewable":true,"lease_duration":600}`,
+			wantCapped: true,
+			wantTTL:    10 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeLeaseVault(map[string]fakeResponse{
+				"/v1/" + renewLeasePath:  {200, tt.renewal},
+				"/v1/" + revokeLeasePath: {204, ""},
+			})
+			server := httptest.NewServer(vault)
+			defer server.Close()
+			r := newTestRenewer(server, nil, vaultLease{})
+			lease := newTrackedLease("", "database/creds/app", vaultLease{ID: "database/creds/app/l1", Renewable: true, Duration: time.Hour})
+			r.leases = []*trackedLease{lease}
+
+			done := make(chan struct{})
+			go func() {
+				r.keepLease(lease)
+				close(done)
+			}()
+			lease.wake <- struct{}{}
+			waitFor(t, "the renewal", func() bool { return vault.count("/v1/"+renewLeasePath) == 1 })
+
+			if tt.wantCapped {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatalf("keepLease() kept renewing a lease capped by its max TTL")
+				}
+			}
+			r.shutdown()
+			if !tt.wantCapped {
+				// Wake the renewal so it sees the renewer stopped.
+				lease.wake <- struct{}{}
+				<-done
+			}
+
+			r.Lock()
+			defer r.Unlock()
+			if lease.capped != tt.wantCapped {
+				t.Errorf("capped = %t, want %t", lease.capped, tt.wantCapped)
+			}
+			if left := time.Until(lease.expiresAt); left > tt.wantTTL || left < tt.wantTTL-time.Minute {
+				t.Errorf("lease expires in %s, want %s", left, tt.wantTTL)
+			}
+			if got := vault.field("/v1/"+renewLeasePath, "lease_id"); got != "database/creds/app/l1" {
+				t.Errorf("renewed lease_id = %v, want database/creds/app/l1", got)
+			}
+			if got := vault.count("/v1/" + revokeLeasePath); got != 1 {
+				t.Errorf("shutdown() revoked %d lease(s), want 1", got)
+			}
+		})
+	}
+}
+
+func TestKeepTokenLogsInAgainWhenRenewalIsDenied(t *testing.T) {
+	vault := newFakeLeaseVault(map[string]fakeResponse{
+		"/v1/" + renewSelfPath: {403, `{"errors":["permission denied"]}`},
+		"/v1/auth/test/login":  {200, `{"auth":{"client_token":"t2","renewable":true,"lease_duration":3600}}`},
+	})
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	r := newTestRenewer(server, testAuth{}, vaultLease{Renewable: true, Duration: 30 * time.Millisecond})
+	r.client.SetToken("t1")
+	lease := newTrackedLease("", "database/creds/app", vaultLease{ID: "l1", Renewable: true, Duration: time.Hour})
+	r.leases = []*trackedLease{lease}
+
+	go r.keepToken()
+	waitFor(t, "the login", func() bool { return vault.count("/v1/auth/test/login") == 1 })
+	waitFor(t, "the new token", func() bool {
+		r.Lock()
+		defer r.Unlock()
+		return r.token.lease.Duration == time.Hour
+	})
+
+	if got := vault.count("/v1/" + renewSelfPath); got != 1 {
+		t.Errorf("renew-self was called %d time(s) before logging in again, want 1", got)
+	}
+	if got := r.client.token.get(); got != "t2" {
+		t.Errorf("token = %q after logging in again, want t2", got)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if lease.tokenExpiresAt.IsZero() {
+		t.Errorf("the lease read with the previous token isn't marked as expiring with it")
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	r := &renewer{
+		token:     newTrackedLease("", "token", vaultLease{Renewable: true, Duration: time.Hour}),
+		stateFile: filepath.Join(t.TempDir(), "state", "leases.json"),
+	}
+	lease := newTrackedLease("", "database/creds/app", vaultLease{ID: "database/creds/app/l1", Renewable: true, Duration: 10 * time.Minute})
+	r.leases = []*trackedLease{lease}
+	r.writeState()
+
+	data, err := ioutil.ReadFile(r.stateFile)
+	if err != nil {
+		t.Fatalf("state file wasn't written: %s", err)
+	}
+	var state struct {
+		Token  leaseState   `json:"token"`
+		Leases []leaseState `json:"leases"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("state file isn't JSON: %s", err)
+	}
+
+	if state.Token.Path != "token" || state.Token.LeaseID != "" || !state.Token.Renewable {
+		t.Errorf("token state = %+v", state.Token)
+	}
+	if len(state.Leases) != 1 {
+		t.Fatalf("state has %d lease(s), want 1", len(state.Leases))
+	}
+	got := state.Leases[0]
+	if got.Path != "database/creds/app" || got.LeaseID != "database/creds/app/l1" || !got.Renewable {
+		t.Errorf("lease state = %+v", got)
+	}
+	if !got.ExpiresAt.Equal(lease.expiresAt.UTC()) || !got.LastRenewed.Equal(lease.lastRenewed.UTC()) {
+		t.Errorf("lease state times = %s/%s, want %s/%s", got.ExpiresAt, got.LastRenewed, lease.expiresAt, lease.lastRenewed)
+	}
+	if got.TTL < 590 || got.TTL > 600 {
+		t.Errorf("lease state ttl = %d, want 600", got.TTL)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	reasonInvalidFormat    = "invalid reference format"
+	reasonPermissionDenied = "permission denied"
+	reasonNotFound         = "not found"
+	reasonUnexpectedStatus = "unexpected response from Vault"
+	reasonOther            = "other errors"
+)
+
+// reasonOrder is the order groups are printed in, roughly from the failures
+// most likely to be fixed in the manifest to those that need an operator.
+var reasonOrder = []string{
+	reasonInvalidFormat,
+	reasonNotFound,
+	reasonPermissionDenied,
+	reasonUnexpectedStatus,
+	reasonOther,
+}
+
+type fetchFailure struct {
+	varName        string
+	vaultNamespace string
+	path           string
+	key            string
+	err            error
+}
+
+func (f fetchFailure) String() string {
+	if f.path == "" {
+		return fmt.Sprintf("%s: %s", f.varName, f.err.Error())
+	}
+	details := []string{"path: " + f.path}
+	if f.vaultNamespace != "" {
+		details = append([]string{"namespace: " + f.vaultNamespace}, details...)
+	}
+	if f.key != "" {
+		details = append(details, "key: "+f.key)
+	}
+	return fmt.Sprintf("%s (%s): %s", f.varName, strings.Join(details, ", "), f.err.Error())
+}
+
+// fetchReport collects every secret that couldn't be fetched, so a single run
+// reports all of them instead of stopping at the first one.
+type fetchReport struct {
+	failures map[string][]fetchFailure
+	count    int
+}
+
+func newFetchReport() *fetchReport {
+	return &fetchReport{failures: map[string][]fetchFailure{}}
+}
+
+func failureReason(err error) string {
+	switch e := err.(type) {
+	case SecretFormatError:
+		return reasonInvalidFormat
+	case SecretNotFoundError:
+		return reasonNotFound
+	case VaultStatusError:
+		if e.StatusCode == 403 {
+			return reasonPermissionDenied
+		}
+		return reasonUnexpectedStatus
+	default:
+		return reasonOther
+	}
+}
+
+// AddFormatError records a reference that couldn't be parsed. Only the
+// variable name is known at that point.
+func (r *fetchReport) AddFormatError(varName string, err error) {
+	r.add(fetchFailure{varName: varName, err: err})
+}
+
+// AddFetchError records a secret that couldn't be fetched from Vault.
+func (r *fetchReport) AddFetchError(secret Secret, err error) {
+	r.add(fetchFailure{
+		varName:        secret.VarName(),
+		vaultNamespace: secret.GetVaultNamespace(),
+		path:           secret.GetPath(),
+		key:            secret.GetKey(),
+		err:            err,
+	})
+}
+
+func (r *fetchReport) add(failure fetchFailure) {
+	reason := failureReason(failure.err)
+	r.failures[reason] = append(r.failures[reason], failure)
+	r.count++
+}
+
+func (r fetchReport) Len() int {
+	return r.count
+}
+
+func (r fetchReport) String() string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "%d secret(s) could not be fetched:", r.count)
+	for _, reason := range reasonOrder {
+		failures := r.failures[reason]
+		if len(failures) == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "\n  %s (%d):", reason, len(failures))
+		for _, failure := range failures {
+			fmt.Fprintf(&builder, "\n    - %s", failure)
+		}
+	}
+	return builder.String()
+}
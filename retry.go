@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRetriesName     = "VAULT_MAX_RETRIES"
+	clientTimeoutName  = "VAULT_CLIENT_TIMEOUT"
+	retryDeadlineName  = "VAULT_RETRY_DEADLINE"
+	retryBackoffName   = "VAULT_RETRY_BACKOFF"
+	retryWaitMinName   = "VAULT_RETRY_WAIT_MIN"
+	retryWaitMaxName   = "VAULT_RETRY_WAIT_MAX"
+	defaultMaxRetries  = 4
+	defaultTimeout     = 60 * time.Second
+	defaultRetryWait   = 1 * time.Second
+	defaultRetryMax    = 30 * time.Second
+	backoffExponential = "exponential"
+	backoffLinear      = "linear"
+	backoffConstant    = "constant"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// retryPolicy decides how often and how long requests to Vault are retried.
+type retryPolicy struct {
+	maxRetries int
+	timeout    time.Duration
+	deadline   time.Duration
+	backoff    string
+	waitMin    time.Duration
+	waitMax    time.Duration
+}
+
+func newRetryPolicy() retryPolicy {
+	policy := retryPolicy{
+		maxRetries: defaultMaxRetries,
+		timeout:    getenvDuration(clientTimeoutName, defaultTimeout),
+		deadline:   getenvDuration(retryDeadlineName, 0),
+		backoff:    backoffExponential,
+		waitMin:    getenvDuration(retryWaitMinName, defaultRetryWait),
+		waitMax:    getenvDuration(retryWaitMaxName, defaultRetryMax),
+	}
+
+	if value, ok := os.LookupEnv(maxRetriesName); ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			log.Fatalf("ERROR: %s must be zero or a positive integer, got '%s'", maxRetriesName, value)
+		}
+		policy.maxRetries = retries
+	}
+	if value := GetenvSafe(retryBackoffName, false); value != "" {
+		switch value {
+		case backoffExponential, backoffLinear, backoffConstant:
+			policy.backoff = value
+		default:
+			log.Fatalf("ERROR: %s must be one of exponential, linear or constant, got '%s'", retryBackoffName, value)
+		}
+	}
+	if policy.waitMax < policy.waitMin {
+		policy.waitMax = policy.waitMin
+	}
+	return policy
+}
+
+// getenvDuration reads a duration such as `30s` or `2m` from key. A bare
+// number is taken as seconds, as the Vault CLI does for VAULT_CLIENT_TIMEOUT.
+func getenvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := GetenvSafe(key, false)
+	if value == "" {
+		return defaultValue
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Fatalf("ERROR: %s must be a duration such as 30s or 2m, got '%s'", key, value)
+	}
+	return duration
+}
+
+// wait returns how long to wait before the given retry, counting from 1,
+// with up to half of it randomised so that pods restarted together don't
+// retry in lockstep.
+func (p retryPolicy) wait(retry int) time.Duration {
+	wait := p.waitMin
+	switch p.backoff {
+	case backoffExponential:
+		for i := 1; i < retry && wait < p.waitMax; i++ {
+			wait = wait * 2
+		}
+	case backoffLinear:
+		wait = p.waitMin * time.Duration(retry)
+	}
+	if wait > p.waitMax {
+		wait = p.waitMax
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryClient sends requests to Vault, retrying the failures that can go
+// away on their own: connection errors, timeouts and 412, 429 and 5xx
+// responses. Anything else, like a 403 or a certificate that doesn't verify,
+// is returned straight away.
+type retryClient struct {
+	httpClient *http.Client
+	policy     retryPolicy
+}
+
+func newRetryClient(httpClient *http.Client, policy retryPolicy) *retryClient {
+	return &retryClient{
+		httpClient: &http.Client{Transport: httpClient.Transport, Timeout: policy.timeout},
+		policy:     policy,
+	}
+}
+
+// withoutRetries returns a copy of the client that makes a single attempt at
+// each request.
+func (c *retryClient) withoutRetries() *retryClient {
+	once := *c
+	once.policy.maxRetries = 0
+	return &once
+}
+
+// withTimeout returns a copy of the client whose attempts time out after
+// timeout.
+func (c *retryClient) withTimeout(timeout time.Duration) *retryClient {
+	limited := *c
+	limited.httpClient = &http.Client{Transport: c.httpClient.Transport, Timeout: timeout}
+	limited.policy.timeout = timeout
+	return &limited
+}
+
+// do sends req and returns the status code and body of the last response.
+// Each retry is logged with its reason; when the retries run out the error,
+// or the log for a final error response, lists what every attempt got. When
+// VAULT_RETRY_DEADLINE passes during an attempt, the response of the attempt
+// before it is returned, if there was one, so the outcome doesn't depend on
+// whether the deadline passed between two attempts or during one.
+func (c *retryClient) do(req *http.Request) (int, []byte, error) {
+	return c.doWithFailover(req, nil)
+}
+
+// doWithFailover is do for a request that can be served by several nodes.
+// After an attempt that couldn't reach its node or got a 5xx response,
+// failover is given the request and the reason, and can point the request
+// at another node; it is then sent there straight away, without using up a
+// retry. The retries and VAULT_RETRY_DEADLINE cover every node together.
+func (c *retryClient) doWithFailover(req *http.Request, failover func(req *http.Request, reason string) bool) (int, []byte, error) {
+	ctx := req.Context()
+	if c.policy.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.policy.deadline)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+	attempts := []string{}
+	description := fmt.Sprintf("%s %s%s", req.Method, req.URL.Host, req.URL.Path)
+	if failover != nil {
+		description = fmt.Sprintf("%s %s", req.Method, req.URL.Path)
+	}
+	lastStatus, lastBody := 0, []byte(nil)
+	deadlinePassed := func(attempt int) (int, []byte, error) {
+		summary := fmt.Sprintf("%s failed after %d attempt(s), %s=%s passed: %s", description, attempt, retryDeadlineName, c.policy.deadline, strings.Join(attempts, "; "))
+		if lastStatus == 0 {
+			return 0, nil, errors.New(summary)
+		}
+		log.Printf("WARN: %s", summary)
+		return lastStatus, lastBody, nil
+	}
+
+	for attempt, retry := 1, 0; ; attempt++ {
+		status, header, body, err := c.send(req)
+		if err == nil && !retryableStatus(status) {
+			return status, body, nil
+		}
+		if err == nil {
+			lastStatus, lastBody = status, body
+		}
+
+		outcome := fmt.Sprintf("Response code: %d", status)
+		if urlErr, ok := err.(*url.Error); ok {
+			outcome = urlErr.Err.Error()
+		} else if err != nil {
+			outcome = err.Error()
+		}
+		if failover != nil {
+			attempts = append(attempts, fmt.Sprintf("attempt %d on %s: %s", attempt, req.URL.Host, outcome))
+		} else {
+			attempts = append(attempts, fmt.Sprintf("attempt %d: %s", attempt, outcome))
+		}
+		if ctx.Err() != nil {
+			return deadlinePassed(attempt)
+		}
+		if failover != nil && (err != nil || status >= 500) && failover(req, outcome) {
+			continue
+		}
+		if err != nil && !retryableError(err) {
+			return 0, nil, err
+		}
+
+		retry++
+		wait, reason := c.policy.wait(retry), "backoff"
+		if retryAfter, ok := parseRetryAfter(header); ok {
+			wait, reason = retryAfter, "Retry-After"
+		}
+		exhausted := ""
+		if retry > c.policy.maxRetries {
+			exhausted = fmt.Sprintf("no retries left (%s=%d)", maxRetriesName, c.policy.maxRetries)
+		} else if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			exhausted = fmt.Sprintf("retrying would pass %s=%s", retryDeadlineName, c.policy.deadline)
+		}
+		if exhausted != "" {
+			summary := fmt.Sprintf("%s failed after %d attempt(s), %s: %s", description, attempt, exhausted, strings.Join(attempts, "; "))
+			if err != nil {
+				return 0, nil, errors.New(summary)
+			}
+			if attempt > 1 {
+				log.Printf("WARN: %s", summary)
+			}
+			return status, body, nil
+		}
+
+		log.Printf("WARN: %s attempt %d failed (%s), retry %d/%d in %s (%s)", description, attempt, outcome, retry, c.policy.maxRetries, wait.Round(time.Millisecond), reason)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return deadlinePassed(attempt)
+		}
+	}
+}
+
+// send makes a single attempt at req and reads the whole response.
+func (c *retryClient) send(req *http.Request) (int, http.Header, []byte, error) {
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		req.Body = body
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("WARN: error closing %s response body: %s\n", req.URL.Path, err.Error())
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed reading %s response body: %s", req.URL.Path, err.Error())
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// retryableStatus reports whether a response may succeed when retried: 412
+// is returned by performance standbys that haven't replicated a write yet,
+// 429 by rate limit quotas and 5xx while a node is sealed or overloaded.
+func retryableStatus(status int) bool {
+	return status == http.StatusPreconditionFailed || status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryableError reports whether err is a connection-level failure, as
+// opposed to one that will fail the same way every time, such as a TLS
+// certificate that doesn't verify.
+func retryableError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter reads a Retry-After header, either in seconds or as an
+// HTTP date.
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{status: 200, want: false},
+		{status: 204, want: false},
+		{status: 400, want: false},
+		{status: 403, want: false},
+		{status: 404, want: false},
+		{status: 412, want: true},
+		{status: 429, want: true},
+		{status: 500, want: true},
+		{status: 502, want: true},
+		{status: 503, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := retryableStatus(tt.status); got != tt.want {
+			t.Errorf("retryableStatus(%d) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection closed", err: &url.Error{Op: "Get", URL: "http://vault", Err: io.EOF}, want: true},
+		{name: "connection cut mid-response", err: io.ErrUnexpectedEOF, want: true},
+		{name: "connection refused", err: &url.Error{Op: "Get", URL: "http://vault", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, want: true},
+		{name: "unknown certificate authority", err: &url.Error{Op: "Get", URL: "https://vault", Err: x509.UnknownAuthorityError{}}, want: false},
+		{name: "other error", err: errors.New("failed reading response body"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableError(tt.err); got != tt.want {
+				t.Errorf("retryableError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantMin time.Duration
+		wantMax time.Duration
+		wantOK  bool
+	}{
+		{name: "absent", value: ""},
+		{name: "seconds", value: "3", wantMin: 3 * time.Second, wantMax: 3 * time.Second, wantOK: true},
+		{name: "zero seconds", value: "0", wantOK: true},
+		{name: "negative seconds", value: "-1"},
+		{name: "HTTP date", value: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), wantMin: 8 * time.Second, wantMax: 10 * time.Second, wantOK: true},
+		{name: "HTTP date in the past", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), wantOK: true},
+		{name: "malformed", value: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			got, ok := parseRetryAfter(header)
+			if ok != tt.wantOK || got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("parseRetryAfter(%q) = %s, %t, want between %s and %s, %t", tt.value, got, ok, tt.wantMin, tt.wantMax, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff string
+		retry   int
+		want    time.Duration
+	}{
+		{name: "exponential first retry", backoff: backoffExponential, retry: 1, want: time.Second},
+		{name: "exponential third retry", backoff: backoffExponential, retry: 3, want: 4 * time.Second},
+		{name: "exponential capped", backoff: backoffExponential, retry: 10, want: 8 * time.Second},
+		{name: "linear", backoff: backoffLinear, retry: 3, want: 3 * time.Second},
+		{name: "linear capped", backoff: backoffLinear, retry: 20, want: 8 * time.Second},
+		{name: "constant", backoff: backoffConstant, retry: 5, want: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := retryPolicy{backoff: tt.backoff, waitMin: time.Second, waitMax: 8 * time.Second}
+			for i := 0; i < 20; i++ {
+				if got := policy.wait(tt.retry); got < tt.want/2 || got > tt.want {
+					t.Fatalf("wait(%d) = %s, want between %s and %s", tt.retry, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+
+	if got := (retryPolicy{backoff: backoffExponential}).wait(1); got != 0 {
+		t.Errorf("wait(1) = %s without a minimum wait, want 0", got)
+	}
+}
+
+func TestNewRetryPolicyDeadline(t *testing.T) {
+	setenv(t, retryDeadlineName, "2m")
+	if got := newRetryPolicy().deadline; got != 2*time.Minute {
+		t.Errorf("deadline = %s with %s=2m, want 2m", got, retryDeadlineName)
+	}
+	setenv(t, retryDeadlineName, "90")
+	if got := newRetryPolicy().deadline; got != 90*time.Second {
+		t.Errorf("deadline = %s with %s=90, want 1m30s", got, retryDeadlineName)
+	}
+}
+
+// countingServer counts the attempts at a request and answers each with
+// respond, counting from 1.
+type countingServer struct {
+	sync.Mutex
+	attempts int
+	respond  func(attempt int, w http.ResponseWriter)
+}
+
+func (s *countingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.attempts++
+	attempt := s.attempts
+	s.Unlock()
+	s.respond(attempt, w)
+}
+
+func (s *countingServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.attempts
+}
+
+// statuses answers each attempt with the next of codes, repeating the last.
+func statuses(codes ...int) func(int, http.ResponseWriter) {
+	return func(attempt int, w http.ResponseWriter) {
+		if attempt > len(codes) {
+			attempt = len(codes)
+		}
+		w.WriteHeader(codes[attempt-1])
+	}
+}
+
+func testRetryPolicy() retryPolicy {
+	return retryPolicy{maxRetries: 2, timeout: time.Second, backoff: backoffConstant, waitMin: time.Millisecond, waitMax: time.Millisecond}
+}
+
+func TestRetryClientDo(t *testing.T) {
+	tests := []struct {
+		name         string
+		respond      func(int, http.ResponseWriter)
+		wantStatus   int
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "success", respond: statuses(200), wantStatus: 200, wantAttempts: 1},
+		{name: "bad request", respond: statuses(400), wantStatus: 400, wantAttempts: 1},
+		{name: "permission denied", respond: statuses(403), wantStatus: 403, wantAttempts: 1},
+		{name: "not found", respond: statuses(404), wantStatus: 404, wantAttempts: 1},
+		{name: "server error", respond: statuses(500), wantStatus: 500, wantAttempts: 3},
+		{name: "sealed then unsealed", respond: statuses(503, 200), wantStatus: 200, wantAttempts: 2},
+		{name: "rate limited", respond: statuses(429, 429, 200), wantStatus: 200, wantAttempts: 3},
+		{name: "standby not caught up", respond: statuses(412), wantStatus: 412, wantAttempts: 3},
+		{
+			name: "connection closed",
+			respond: func(attempt int, w http.ResponseWriter) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			wantAttempts: 3,
+			wantErr:      "failed after 3 attempt(s), no retries left (VAULT_MAX_RETRIES=2)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := &countingServer{respond: tt.respond}
+			server := httptest.NewServer(counter)
+			defer server.Close()
+			client := newRetryClient(http.DefaultClient, testRetryPolicy())
+
+			req, _ := http.NewRequest("GET", server.URL+"/v1/kv/data/app", nil)
+			status, _, err := client.do(req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("do() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("do() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("do() status = %d, want %d", status, tt.wantStatus)
+			}
+			if got := counter.count(); got != tt.wantAttempts {
+				t.Errorf("server got %d attempt(s), want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryClientDoConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	client := newRetryClient(http.DefaultClient, testRetryPolicy())
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/kv/data/app", nil)
+	if _, _, err := client.do(req); err == nil || !strings.Contains(err.Error(), "failed after 3 attempt(s)") {
+		t.Errorf("do() error = %v, want it to fail after 3 attempts", err)
+	}
+}
+
+func TestRetryClientDoRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		wantWait   time.Duration
+	}{
+		{name: "seconds", retryAfter: func() string { return "1" }, wantWait: time.Second},
+		{
+			name: "HTTP date",
+			// The date has no fraction of a second, so the wait is at least 1s.
+			retryAfter: func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) },
+			wantWait:   time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := &countingServer{respond: func(attempt int, w http.ResponseWriter) {
+				if attempt == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter())
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			}}
+			server := httptest.NewServer(counter)
+			defer server.Close()
+			client := newRetryClient(http.DefaultClient, testRetryPolicy())
+
+			start := time.Now()
+			req, _ := http.NewRequest("GET", server.URL+"/v1/kv/data/app", nil)
+			status, _, err := client.do(req)
+			if err != nil || status != 200 {
+				t.Fatalf("do() = %d, %v, want 200", status, err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantWait-50*time.Millisecond {
+				t.Errorf("do() retried after %s, want Retry-After's %s", elapsed, tt.wantWait)
+			}
+			if got := counter.count(); got != 2 {
+				t.Errorf("server got %d attempt(s), want 2", got)
+			}
+		})
+	}
+}
+
+func TestRetryClientDoDeadline(t *testing.T) {
+	tests := []struct {
+		name         string
+		respond      func(int, http.ResponseWriter)
+		wantStatus   int
+		wantAttempts int
+		wantErr      string
+	}{
+		{
+			name: "Retry-After past the deadline",
+			respond: func(attempt int, w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantStatus:   503,
+			wantAttempts: 1,
+		},
+		{
+			name: "attempt outlasting the deadline",
+			respond: func(attempt int, w http.ResponseWriter) {
+				time.Sleep(300 * time.Millisecond)
+			},
+			wantAttempts: 1,
+			wantErr:      "VAULT_RETRY_DEADLINE=200ms passed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := &countingServer{respond: tt.respond}
+			server := httptest.NewServer(counter)
+			defer server.Close()
+			policy := testRetryPolicy()
+			policy.maxRetries, policy.deadline = 100, 200*time.Millisecond
+			client := newRetryClient(http.DefaultClient, policy)
+
+			start := time.Now()
+			req, _ := http.NewRequest("GET", server.URL+"/v1/kv/data/app", nil)
+			status, _, err := client.do(req)
+			if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+				t.Errorf("do() returned after %s, want it to give up by the 200ms deadline", elapsed)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("do() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("do() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("do() status = %d, want %d", status, tt.wantStatus)
+			}
+			if got := counter.count(); got != tt.wantAttempts {
+				t.Errorf("server got %d attempt(s), want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryClientDoDeadlineDuringAttempt(t *testing.T) {
+	// The first attempt gets a 503 and the second one hangs until the
+	// deadline passes, which has to return the 503 rather than a timeout.
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		attempt := attempts
+		mu.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors":["Vault is sealed"]}`))
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	policy := testRetryPolicy()
+	policy.maxRetries, policy.deadline = 100, 300*time.Millisecond
+	client := newRetryClient(http.DefaultClient, policy)
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/kv/data/app", nil)
+	status, body, err := client.do(req)
+	if err != nil || status != 503 {
+		t.Fatalf("do() = %d, %v, want the 503 of the attempt before the deadline", status, err)
+	}
+	if string(body) != `{"errors":["Vault is sealed"]}` {
+		t.Errorf("do() body = %q, want the 503's", body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("server got %d attempt(s), want 2", attempts)
+	}
+}
@@ -1,4 +1,8 @@
 #!/bin/bash
 set -e
 
-./scripts/run-e2e-tests.sh
\ No newline at end of file
+# Unit tests of the root module; the e2e module under e2e/ is run by the
+# script below.
+go test -race ./...
+
+./scripts/run-e2e-tests.sh
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+const (
+	secretTypeAWS          = "aws"
+	awsCredentialsFileName = "AWS_SHARED_CREDENTIALS_FILE"
+)
+
+// awsFields are the fields of an `aws/creds/<role>` or `aws/sts/<role>`
+// response, with the variables and credentials file keys the AWS SDKs read
+// them from. The session token is null for IAM user credentials.
+var awsFields = []struct {
+	field   string
+	envName string
+	fileKey string
+}{
+	{"access_key", "AWS_ACCESS_KEY_ID", "aws_access_key_id"},
+	{"secret_key", "AWS_SECRET_ACCESS_KEY", "aws_secret_access_key"},
+	{"security_token", "AWS_SESSION_TOKEN", "aws_session_token"},
+}
+
+var awsProfileRegex = regexp.MustCompile(`^[A-Za-z0-9_.@+-]+$`)
+
+// validateAWSSecret checks a reference to credentials from the AWS secrets
+// engine. They are set in the variables the AWS SDKs read unless env names
+// others, or written under profile to file, a shared credentials file.
+func validateAWSSecret(secret *v2Secret, dynamic *dynamicSecret) error {
+	if err := validateDynamicSecret(secret, dynamic); err != nil {
+		return err
+	}
+	if dynamic.File != "" {
+		if dynamic.Env != nil {
+			return NewSecretFormatError(fmt.Sprintf("invalid aws reference for '%s': env and file can't be used together", secret.Path))
+		}
+		if dynamic.Profile == "" {
+			dynamic.Profile = defaultAWSProfile
+		}
+		if !awsProfileRegex.MatchString(dynamic.Profile) {
+			return NewSecretFormatError(fmt.Sprintf("invalid aws reference for '%s': '%s' is not a valid profile name", secret.Path, dynamic.Profile))
+		}
+		return nil
+	}
+
+	if dynamic.Profile != "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid aws reference for '%s': profile only applies with file", secret.Path))
+	}
+	if dynamic.Env == nil {
+		dynamic.Env = map[string]string{}
+		for _, f := range awsFields {
+			dynamic.Env[f.field] = f.envName
+		}
+	}
+	return validateEnv(secret, dynamic)
+}
+
+// awsFileFields returns the fields written to a credentials file.
+func awsFileFields() []string {
+	fields := []string{}
+	for _, f := range awsFields {
+		fields = append(fields, f.field)
+	}
+	return fields
+}
+
+// writeAWSCredentials writes the AWS credentials of secrets that go to a
+// file, with one profile per secret, to shared credentials files readable
+// only by the owner.
+func writeAWSCredentials(secrets []Secret) error {
+	files := []string{}
+	profiles := map[string]map[string]bool{}
+	contents := map[string]*bytes.Buffer{}
+
+	for _, secret := range secrets {
+		dynamic := dynamicOf(secret)
+		if dynamic == nil || dynamic.Type != secretTypeAWS || dynamic.File == "" || dynamic.fields == nil {
+			continue
+		}
+		file := dynamic.File
+		if _, ok := contents[file]; !ok {
+			files = append(files, file)
+			profiles[file] = map[string]bool{}
+			contents[file] = &bytes.Buffer{}
+		}
+		if profiles[file][dynamic.Profile] {
+			return fmt.Errorf("%s writes profile '%s' to %s, which another secret already writes", secret.VarName(), dynamic.Profile, file)
+		}
+		profiles[file][dynamic.Profile] = true
+
+		content := contents[file]
+		if content.Len() > 0 {
+			content.WriteString("\n")
+		}
+		fmt.Fprintf(content, "[%s]\n", dynamic.Profile)
+		for _, f := range awsFields {
+			if value, ok := dynamic.fields[f.field]; ok {
+				fmt.Fprintf(content, "%s = %s\n", f.fileKey, value)
+			}
+		}
+	}
+
+	for _, file := range files {
+		addSecretFile(file)
+		if err := writeFileAtomic(file, contents[file].Bytes(), 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %s", file, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateAWSSecret(t *testing.T) {
+	tests := []struct {
+		name        string
+		reference   string
+		wantEnv     map[string]string
+		wantProfile string
+		wantErr     string
+	}{
+		{
+			name:      "default variables",
+			reference: `{"type":"aws","path":"aws/creds/deploy"}`,
+			wantEnv:   map[string]string{"access_key": "AWS_ACCESS_KEY_ID", "secret_key": "AWS_SECRET_ACCESS_KEY", "security_token": "AWS_SESSION_TOKEN"},
+		},
+		{
+			name:      "custom variables",
+			reference: `{"type":"aws","path":"aws/sts/deploy","env":{"access_key":"KEY_ID","secret_key":"SECRET"}}`,
+			wantEnv:   map[string]string{"access_key": "KEY_ID", "secret_key": "SECRET"},
+		},
+		{
+			name:        "file with the default profile",
+			reference:   `{"type":"aws","path":"aws/sts/deploy","file":"/var/run/aws/credentials"}`,
+			wantProfile: "default",
+		},
+		{
+			name:        "file with a profile",
+			reference:   `{"type":"aws","path":"aws/sts/deploy","file":"/var/run/aws/credentials","profile":"deploy"}`,
+			wantProfile: "deploy",
+		},
+		{
+			name:      "env and file",
+			reference: `{"type":"aws","path":"aws/sts/deploy","file":"/credentials","env":{"access_key":"KEY_ID"}}`,
+			wantErr:   "env and file can't be used together",
+		},
+		{
+			name:      "profile without file",
+			reference: `{"type":"aws","path":"aws/sts/deploy","profile":"deploy"}`,
+			wantErr:   "profile only applies with file",
+		},
+		{
+			name:      "invalid profile",
+			reference: `{"type":"aws","path":"aws/sts/deploy","file":"/credentials","profile":"de ploy]"}`,
+			wantErr:   "not a valid profile name",
+		},
+		{
+			name:      "invalid variable",
+			reference: `{"type":"aws","path":"aws/sts/deploy","env":{"access_key":"1KEY"}}`,
+			wantErr:   "not a valid variable name",
+		},
+		{
+			name:      "variable set twice",
+			reference: `{"type":"aws","path":"aws/sts/deploy","env":{"access_key":"KEY","secret_key":"KEY"}}`,
+			wantErr:   "set from more than one field",
+		},
+		{
+			name:      "version",
+			reference: `{"type":"aws","path":"aws/sts/deploy","version":2}`,
+			wantErr:   "only apply to kv",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := newV2Secret("AWS", []byte(tt.reference))
+			if tt.wantErr != "" {
+				if _, ok := err.(SecretFormatError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newV2Secret() error = %v, want a format error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newV2Secret() error = %v", err)
+			}
+			if secret.dynamic.Profile != tt.wantProfile {
+				t.Errorf("profile = %q, want %q", secret.dynamic.Profile, tt.wantProfile)
+			}
+			if len(secret.dynamic.Env) != len(tt.wantEnv) {
+				t.Fatalf("env = %v, want %v", secret.dynamic.Env, tt.wantEnv)
+			}
+			for field, name := range tt.wantEnv {
+				if secret.dynamic.Env[field] != name {
+					t.Errorf("env[%s] = %q, want %q", field, secret.dynamic.Env[field], name)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAWSCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aws", "credentials")
+	newSecret := func(varName, profile string, fields map[string]string) *v2Secret {
+		t.Helper()
+		secret, err := newV2Secret(varName, []byte(`{"type":"aws","path":"aws/sts/`+profile+`","file":"`+file+`","profile":"`+profile+`"}`))
+		if err != nil {
+			t.Fatalf("newV2Secret() error = %v", err)
+		}
+		secret.dynamic.fields = fields
+		return secret
+	}
+	deploy := newSecret("DEPLOY", "deploy", map[string]string{"access_key": "ASIA1", "secret_key": "s1", "security_token": "t1"})
+	// IAM user credentials have no session token.
+	user := newSecret("USER", "user", map[string]string{"access_key": "AKIA2", "secret_key": "s2"})
+
+	if err := writeAWSCredentials([]Secret{deploy, user}); err != nil {
+		t.Fatalf("writeAWSCredentials() error = %v", err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("credentials file wasn't written: %s", err)
+	}
+	want := `[deploy]
+aws_access_key_id = ASIA1
+aws_secret_access_key = s1
+aws_session_token = t1
+
+[user]
+aws_access_key_id = AKIA2
+aws_secret_access_key = s2
+`
+	if string(content) != want {
+		t.Errorf("credentials file =\n%s\nwant\n%s", content, want)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", file, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credentials file mode = %s, want -rw-------", info.Mode().Perm())
+	}
+	if !isSecretFile(file) {
+		t.Errorf("credentials file isn't recorded as a secret file, the fetcher could read it back as its own credentials")
+	}
+
+	again := newSecret("AGAIN", "deploy", deploy.dynamic.fields)
+	if err := writeAWSCredentials([]Secret{deploy, again}); err == nil || !strings.Contains(err.Error(), "profile 'deploy'") {
+		t.Errorf("writeAWSCredentials() error = %v, want one for a profile written twice", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+)
+
+const secretTypeDatabase = "database"
+
+// validateDatabaseSecret checks a reference to credentials from the database
+// secrets engine, such as `database/creds/<role>`. Its username and password
+// are set in `<VAR>_USERNAME` and `<VAR>_PASSWORD` unless env names other
+// variables for them.
+func validateDatabaseSecret(secret *v2Secret, dynamic *dynamicSecret) error {
+	if err := validateDynamicSecret(secret, dynamic); err != nil {
+		return err
+	}
+	if dynamic.File != "" || dynamic.Profile != "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid database reference for '%s': database credentials can't be written to a file", secret.Path))
+	}
+	if dynamic.Env == nil {
+		dynamic.Env = map[string]string{
+			"username": secret.varName + "_USERNAME",
+			"password": secret.varName + "_PASSWORD",
+		}
+	}
+	return validateEnv(secret, dynamic)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDatabaseSecret(t *testing.T) {
+	tests := []struct {
+		name      string
+		reference string
+		wantEnv   map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "default variables",
+			reference: `{"type":"database","path":"database/creds/app"}`,
+			wantEnv:   map[string]string{"username": "DB_USERNAME", "password": "DB_PASSWORD"},
+		},
+		{
+			name:      "custom variables",
+			reference: `{"type":"database","path":"database/creds/app","env":{"username":"PGUSER","password":"PGPASSWORD"}}`,
+			wantEnv:   map[string]string{"username": "PGUSER", "password": "PGPASSWORD"},
+		},
+		{
+			name:      "empty env",
+			reference: `{"type":"database","path":"database/creds/app","env":{}}`,
+			wantErr:   "no variable to set",
+		},
+		{
+			name:      "invalid variable",
+			reference: `{"type":"database","path":"database/creds/app","env":{"username":"PG-USER"}}`,
+			wantErr:   "not a valid variable name",
+		},
+		{
+			name:      "variable set twice",
+			reference: `{"type":"database","path":"database/creds/app","env":{"username":"PG","password":"PG"}}`,
+			wantErr:   "set from more than one field",
+		},
+		{
+			name:      "file",
+			reference: `{"type":"database","path":"database/creds/app","file":"/var/run/db"}`,
+			wantErr:   "can't be written to a file",
+		},
+		{
+			name:      "key",
+			reference: `{"type":"database","path":"database/creds/app","key":"password"}`,
+			wantErr:   "only apply to kv",
+		},
+		{
+			name:      "default",
+			reference: `{"type":"database","path":"database/creds/app","default":"none"}`,
+			wantErr:   "only apply to kv",
+		},
+		{
+			name:      "unknown type",
+			reference: `{"type":"postgres","path":"database/creds/app"}`,
+			wantErr:   "invalid type 'postgres'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := newV2Secret("DB", []byte(tt.reference))
+			if tt.wantErr != "" {
+				if _, ok := err.(SecretFormatError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newV2Secret() error = %v, want a format error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newV2Secret() error = %v", err)
+			}
+			if len(secret.dynamic.Env) != len(tt.wantEnv) {
+				t.Fatalf("env = %v, want %v", secret.dynamic.Env, tt.wantEnv)
+			}
+			for field, name := range tt.wantEnv {
+				if secret.dynamic.Env[field] != name {
+					t.Errorf("env[%s] = %q, want %q", field, secret.dynamic.Env[field], name)
+				}
+			}
+		})
+	}
+}
+
+func TestDatabaseSecretEnvironment(t *testing.T) {
+	secret, err := newV2Secret("DB", []byte(`{"type":"database","path":"database/creds/app"}`))
+	if err != nil {
+		t.Fatalf("newV2Secret() error = %v", err)
+	}
+	resp := VaultV1Response{Data: VaultV1Data{"username": "v-app-1", "password": "s3cr3t"}}
+	if err := extractSecret(resp, secret); err != nil {
+		t.Fatalf("extractSecret() error = %v", err)
+	}
+
+	env := entrypointEnv{"DB": "VAULTSECRET::{}"}
+	setSecretEnv(env, secret)
+	if env["DB_USERNAME"] != "v-app-1" || env["DB_PASSWORD"] != "s3cr3t" {
+		t.Errorf("env = %v, want DB_USERNAME and DB_PASSWORD set", env)
+	}
+	if _, ok := env["DB"]; ok {
+		t.Errorf("the reference's own variable is still set")
+	}
+}
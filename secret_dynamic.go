@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dynamicSecret holds the options of a reference to a secret Vault generates
+// when it is read, such as database credentials or a certificate, rather
+// than a key of a KV secret, along with the fields read from the response.
+type dynamicSecret struct {
+	// Type is the secrets engine the secret comes from.
+	Type string `json:"type"`
+	// Env maps fields of the response to the environment variables set
+	// from them; it is nil for secrets written to a file.
+	Env map[string]string `json:"env"`
+	// File is the file the secret is written to instead of the
+	// environment, and Profile the profile AWS credentials are written
+	// under in it.
+	File    string `json:"file"`
+	Profile string `json:"profile"`
+	// Dir is the directory an issued certificate is written to.
+	Dir        string `json:"dir"`
+	CommonName string `json:"common_name"`
+	AltNames   string `json:"alt_names"`
+	TTL        string `json:"ttl"`
+	// params are the parameters written to the secret's path to issue it,
+	// or nil for secrets that are read.
+	params map[string]interface{}
+	// fields are the fields read from the response, by name.
+	fields map[string]string
+}
+
+// dynamicOf returns the dynamic secret secret references, or nil when it
+// references a key of a KV secret.
+func dynamicOf(secret Secret) *dynamicSecret {
+	if s, ok := secret.(*v2Secret); ok {
+		return s.dynamic
+	}
+	return nil
+}
+
+// hasOptions reports whether any option of a dynamic secret is set.
+func (d *dynamicSecret) hasOptions() bool {
+	return d.Env != nil || d.File != "" || d.Profile != "" || d.Dir != "" || d.CommonName != "" || d.AltNames != "" || d.TTL != ""
+}
+
+// fieldNames returns the fields the secret reads: those mapped to
+// variables, or those written to its file.
+func (d *dynamicSecret) fieldNames() []string {
+	if d.Type == secretTypeAWS && d.File != "" {
+		return awsFileFields()
+	}
+	if d.Type == secretTypeGCP && d.File != "" {
+		return []string{gcpPrivateKeyDataField}
+	}
+	fields := []string{}
+	for field := range d.Env {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// environment returns the variables the secret sets, by name: those set
+// from its fields, or the one pointing the SDKs at its file.
+func (d *dynamicSecret) environment() map[string]string {
+	env := map[string]string{}
+	for field, name := range d.Env {
+		if value, ok := d.fields[field]; ok {
+			env[name] = value
+		}
+	}
+	if d.Type == secretTypeAWS && d.File != "" {
+		env[awsCredentialsFileName] = d.File
+	}
+	if d.Type == secretTypeGCP && d.File != "" {
+		env[gcpCredentialsName] = d.File
+	}
+	return env
+}
+
+// writesFiles reports whether the secret is written to files.
+func (d *dynamicSecret) writesFiles() bool {
+	return d.File != "" || d.Dir != ""
+}
+
+// validateDynamicSecret checks the options shared by the types that read a
+// dynamic secret, which have no key or version and change on every read.
+func validateDynamicSecret(secret *v2Secret, dynamic *dynamicSecret) error {
+	if secret.Key != "" || secret.Select != "" || secret.KVVersion != 0 || secret.Default != nil || secret.OnChange != "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid %s reference for '%s': key, select, version, default and on_change only apply to kv", dynamic.Type, secret.Path))
+	}
+	return nil
+}
+
+// validateEnv checks that the variables a secret sets from several fields
+// are valid and distinct.
+func validateEnv(secret *v2Secret, dynamic *dynamicSecret) error {
+	if len(dynamic.Env) == 0 {
+		return NewSecretFormatError(fmt.Sprintf("invalid env for '%s': no variable to set", secret.Path))
+	}
+	seen := map[string]bool{}
+	for field, name := range dynamic.Env {
+		if !envNameRegex.MatchString(name) {
+			return NewSecretFormatError(fmt.Sprintf("invalid env for '%s': '%s' is not a valid variable name for %s", secret.Path, name, field))
+		}
+		if seen[name] {
+			return NewSecretFormatError(fmt.Sprintf("invalid env for '%s': %s is set from more than one field", secret.Path, name))
+		}
+		seen[name] = true
+	}
+	return nil
+}
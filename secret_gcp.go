@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	secretTypeGCP                = "gcp"
+	gcpCredentialsName           = "GOOGLE_APPLICATION_CREDENTIALS"
+	gcpTokenField                = "token"
+	gcpPrivateKeyDataField       = "private_key_data"
+	gcpServiceAccountKeyFileMode = 0600
+)
+
+// validateGCPSecret checks a reference to the GCP secrets engine: a
+// service account key, such as `gcp/key/<roleset>`, written to file, or an
+// OAuth token, such as `gcp/roleset/<name>/token`, set in the reference's
+// own variable unless env names another one.
+func validateGCPSecret(secret *v2Secret, dynamic *dynamicSecret) error {
+	if err := validateDynamicSecret(secret, dynamic); err != nil {
+		return err
+	}
+	if dynamic.Profile != "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid gcp reference for '%s': profile only applies to aws", secret.Path))
+	}
+	if dynamic.File != "" {
+		if dynamic.Env != nil {
+			return NewSecretFormatError(fmt.Sprintf("invalid gcp reference for '%s': env and file can't be used together", secret.Path))
+		}
+		if !isGCPKeyPath(secret.Path) {
+			return NewSecretFormatError(fmt.Sprintf("invalid gcp reference for '%s': only service account keys are written to a file, tokens go to env", secret.Path))
+		}
+		return nil
+	}
+	if isGCPKeyPath(secret.Path) {
+		return NewSecretFormatError(fmt.Sprintf("invalid gcp reference for '%s': service account keys are written to a file, file is required", secret.Path))
+	}
+	if dynamic.Env == nil {
+		dynamic.Env = map[string]string{gcpTokenField: secret.varName}
+	}
+	return validateEnv(secret, dynamic)
+}
+
+// isGCPKeyPath reports whether secretPath generates a service account key
+// rather than a token: `<mount>/key/<roleset>`, or
+// `<mount>/roleset/<roleset>/key` and `<mount>/static-account/<name>/key`.
+func isGCPKeyPath(secretPath string) bool {
+	parts := strings.Split(strings.Trim(secretPath, "/"), "/")
+	if len(parts) < 3 {
+		return false
+	}
+	last := len(parts) - 1
+	// A roleset or account may itself be named `key`.
+	named := parts[last-2] == "roleset" || parts[last-2] == "static-account"
+	if named {
+		return parts[last] == "key"
+	}
+	return parts[last-1] == "key"
+}
+
+// writeGCPKeys decodes the service account keys of secrets that go to a
+// file and writes them as JSON key files readable only by the owner.
+func writeGCPKeys(secrets []Secret) error {
+	written := map[string]string{}
+	for _, secret := range secrets {
+		dynamic := dynamicOf(secret)
+		if dynamic == nil || dynamic.Type != secretTypeGCP || dynamic.File == "" || dynamic.fields == nil {
+			continue
+		}
+		file := dynamic.File
+		if other, ok := written[file]; ok {
+			return fmt.Errorf("%s writes a key to %s, which %s already writes", secret.VarName(), file, other)
+		}
+		written[file] = secret.VarName()
+
+		key, err := base64.StdEncoding.DecodeString(dynamic.fields[gcpPrivateKeyDataField])
+		if err != nil {
+			return fmt.Errorf("failed to decode the %s of %s: %s", gcpPrivateKeyDataField, secret.VarName(), err.Error())
+		}
+		if err := writeFileAtomic(file, key, gcpServiceAccountKeyFileMode); err != nil {
+			return fmt.Errorf("failed to write %s: %s", file, err.Error())
+		}
+	}
+	return nil
+}
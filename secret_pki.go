@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	secretTypePKI       = "pki"
+	pkiCertificateFile  = "cert.pem"
+	pkiPrivateKeyFile   = "key.pem"
+	pkiCAChainFile      = "ca.pem"
+	pkiBundleFile       = "bundle.pem"
+	pkiCertificateField = "certificate"
+	pkiPrivateKeyField  = "private_key"
+	pkiIssuingCAField   = "issuing_ca"
+	pkiCAChainField     = "ca_chain"
+	pkiExpirationField  = "expiration"
+)
+
+// validatePKISecret checks a reference that issues a certificate from the
+// PKI secrets engine, such as `pki/issue/<role>`, and writes it to dir.
+// common_name, alt_names and ttl may refer to the fetcher's environment as
+// `${VAR}`, so that a pod can ask for its own names.
+func validatePKISecret(secret *v2Secret, dynamic *dynamicSecret) error {
+	if err := validateDynamicSecret(secret, dynamic); err != nil {
+		return err
+	}
+	if dynamic.Env != nil || dynamic.File != "" || dynamic.Profile != "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid pki reference for '%s': certificates are written to dir, env, file and profile don't apply", secret.Path))
+	}
+	if dynamic.Dir == "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid pki reference for '%s': dir is required", secret.Path))
+	}
+
+	var err error
+	for _, field := range []*string{&dynamic.CommonName, &dynamic.AltNames, &dynamic.TTL} {
+		if *field, err = expandEnv(*field); err != nil {
+			return NewSecretFormatError(fmt.Sprintf("invalid pki reference for '%s': %s", secret.Path, err.Error()))
+		}
+	}
+	if dynamic.CommonName == "" {
+		return NewSecretFormatError(fmt.Sprintf("invalid pki reference for '%s': common_name is required", secret.Path))
+	}
+	return nil
+}
+
+// expandEnv replaces `${VAR}` and `$VAR` in value with the variable's value,
+// such as a POD_NAME set from the downward API. Unset variables are an
+// error rather than an empty name.
+func expandEnv(value string) (string, error) {
+	missing := []string{}
+	expanded := os.Expand(value, func(name string) string {
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// pkiParams returns the parameters a certificate is issued with.
+func pkiParams(dynamic *dynamicSecret) map[string]interface{} {
+	params := map[string]interface{}{"common_name": dynamic.CommonName}
+	if dynamic.AltNames != "" {
+		params["alt_names"] = dynamic.AltNames
+	}
+	if dynamic.TTL != "" {
+		params["ttl"] = dynamic.TTL
+	}
+	return params
+}
+
+// pkiIssueResponse is the response of `pki/issue/<role>`.
+type pkiIssueResponse struct {
+	VaultV1Response
+}
+
+// GetLease returns how long the certificate is valid for. Certificates
+// aren't leased unless the role says so, but they are reissued before they
+// expire all the same.
+func (r pkiIssueResponse) GetLease() vaultLease {
+	lease := r.VaultV1Response.GetLease()
+	if lease.ID != "" {
+		return lease
+	}
+	if expiration, ok := r.Data[pkiExpirationField].(json.Number); ok {
+		if seconds, err := expiration.Int64(); err == nil {
+			lease.Duration = time.Until(time.Unix(seconds, 0))
+		}
+	}
+	return lease
+}
+
+// issueCertificate issues a certificate by writing params to secretPath.
+func (vc VaultClient) issueCertificate(namespace, secretPath string, params map[string]interface{}) (VaultReadResponse, error) {
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req := vc.newRequest("POST", secretPath, payload)
+	vc.setNamespace(req, namespace)
+	status, body, err := vc.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, NewVaultStatusError(fmt.Sprintf("FetchSecret() failed to issue a certificate from '%s' - Response code: %d - %s", secretPath, status, body), status)
+	}
+
+	var resp pkiIssueResponse
+	if err := decodeVaultResponse(body, &resp.VaultV1Response); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// extractPKIFields sets the certificate, private key and CA chain of an
+// issued certificate.
+func extractPKIFields(resp VaultReadResponse, dynamic *dynamicSecret) error {
+	fields := map[string]string{}
+	for _, field := range []string{pkiCertificateField, pkiPrivateKeyField, pkiIssuingCAField} {
+		value, ok := resp.GetData()[field].(string)
+		if !ok {
+			return fmt.Errorf("error extracting certificate from response: no value for field: %s", field)
+		}
+		fields[field] = value
+	}
+
+	// ca_chain holds the issuing CA and any intermediates above it; older
+	// Vault versions only return issuing_ca.
+	chain := []string{}
+	if values, ok := resp.GetData()[pkiCAChainField].([]interface{}); ok {
+		for _, value := range values {
+			if pem, ok := value.(string); ok {
+				chain = append(chain, strings.TrimSpace(pem))
+			}
+		}
+	}
+	if len(chain) == 0 {
+		chain = append(chain, strings.TrimSpace(fields[pkiIssuingCAField]))
+	}
+	fields[pkiCAChainField] = strings.Join(chain, "\n")
+
+	dynamic.fields = fields
+	return nil
+}
+
+// writePKIFiles writes the certificates of secrets to their directories: the
+// certificate, its private key, the CA chain and a bundle of all three in
+// the order of Vault's pem_bundle. The key and the bundle are readable only
+// by the owner.
+func writePKIFiles(secrets []Secret) error {
+	written := map[string]string{}
+	for _, secret := range secrets {
+		dynamic := dynamicOf(secret)
+		if dynamic == nil || dynamic.Type != secretTypePKI || dynamic.fields == nil {
+			continue
+		}
+		dir := dynamic.Dir
+		if other, ok := written[dir]; ok {
+			return fmt.Errorf("%s writes a certificate to %s, which %s already writes", secret.VarName(), dir, other)
+		}
+		written[dir] = secret.VarName()
+
+		fields := dynamic.fields
+		cert := strings.TrimSpace(fields[pkiCertificateField])
+		key := strings.TrimSpace(fields[pkiPrivateKeyField])
+		chain := fields[pkiCAChainField]
+		files := []struct {
+			name    string
+			content string
+			perm    os.FileMode
+		}{
+			{pkiCertificateFile, cert, 0644},
+			{pkiCAChainFile, chain, 0644},
+			{pkiPrivateKeyFile, key, 0600},
+			{pkiBundleFile, strings.Join([]string{key, cert, chain}, "\n"), 0600},
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.name)
+			if err := writeFileAtomic(path, []byte(file.content+"\n"), file.perm); err != nil {
+				return fmt.Errorf("failed to write %s: %s", path, err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePKISecret(t *testing.T) {
+	setenv(t, "POD_NAME", "app-0")
+
+	tests := []struct {
+		name           string
+		reference      string
+		wantCommonName string
+		wantErr        string
+	}{
+		{
+			name:           "common name from the environment",
+			reference:      `{"type":"pki","path":"pki/issue/internal","dir":"/tls","common_name":"${POD_NAME}.svc"}`,
+			wantCommonName: "app-0.svc",
+		},
+		{
+			name:      "unset variable",
+			reference: `{"type":"pki","path":"pki/issue/internal","dir":"/tls","common_name":"${POD_IP}"}`,
+			wantErr:   "POD_IP not set",
+		},
+		{
+			name:      "no dir",
+			reference: `{"type":"pki","path":"pki/issue/internal","common_name":"app"}`,
+			wantErr:   "dir is required",
+		},
+		{
+			name:      "no common name",
+			reference: `{"type":"pki","path":"pki/issue/internal","dir":"/tls"}`,
+			wantErr:   "common_name is required",
+		},
+		{
+			name:      "file",
+			reference: `{"type":"pki","path":"pki/issue/internal","dir":"/tls","common_name":"app","file":"/tls/cert.pem"}`,
+			wantErr:   "env, file and profile don't apply",
+		},
+		{
+			name:      "key",
+			reference: `{"type":"pki","path":"pki/issue/internal","dir":"/tls","common_name":"app","key":"certificate"}`,
+			wantErr:   "only apply to kv",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := newV2Secret("TLS", []byte(tt.reference))
+			if tt.wantErr != "" {
+				if _, ok := err.(SecretFormatError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newV2Secret() error = %v, want a format error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newV2Secret() error = %v", err)
+			}
+			if got := secret.dynamic.params["common_name"]; got != tt.wantCommonName {
+				t.Errorf("common_name = %v, want %s", got, tt.wantCommonName)
+			}
+		})
+	}
+}
+
+func TestExtractPKIFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      VaultV1Data
+		wantChain string
+		wantErr   string
+	}{
+		{
+			name: "ca_chain",
+			data: VaultV1Data{
+				"certificate": "CERT", "private_key": "KEY", "issuing_ca": "ISSUER",
+				"ca_chain": []interface{}{"ISSUER\n", "ROOT\n"},
+			},
+			wantChain: "ISSUER\nROOT",
+		},
+		{
+			name:      "issuing_ca only",
+			data:      VaultV1Data{"certificate": "CERT", "private_key": "KEY", "issuing_ca": "ISSUER\n"},
+			wantChain: "ISSUER",
+		},
+		{
+			name:    "no private key",
+			data:    VaultV1Data{"certificate": "CERT", "issuing_ca": "ISSUER"},
+			wantErr: "no value for field: private_key",
+		},
+		{
+			name:    "certificate not a string",
+			data:    VaultV1Data{"certificate": []interface{}{"CERT"}, "private_key": "KEY", "issuing_ca": "ISSUER"},
+			wantErr: "no value for field: certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamic := &dynamicSecret{Type: secretTypePKI}
+			err := extractPKIFields(VaultV1Response{Data: tt.data}, dynamic)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractPKIFields() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPKIFields() error = %v", err)
+			}
+			if got := dynamic.fields[pkiCAChainField]; got != tt.wantChain {
+				t.Errorf("chain = %q, want %q", got, tt.wantChain)
+			}
+		})
+	}
+}
+
+func TestWritePKIFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	secret, err := newV2Secret("TLS", []byte(`{"type":"pki","path":"pki/issue/internal","dir":"`+dir+`","common_name":"app"}`))
+	if err != nil {
+		t.Fatalf("newV2Secret() error = %v", err)
+	}
+	secret.dynamic.fields = map[string]string{
+		pkiCertificateField: "CERT\n",
+		pkiPrivateKeyField:  "KEY\n",
+		pkiCAChainField:     "ISSUER\nROOT",
+	}
+
+	if err := writePKIFiles([]Secret{secret}); err != nil {
+		t.Fatalf("writePKIFiles() error = %v", err)
+	}
+
+	want := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+	}{
+		{pkiCertificateFile, "CERT\n", 0644},
+		{pkiCAChainFile, "ISSUER\nROOT\n", 0644},
+		{pkiPrivateKeyFile, "KEY\n", 0600},
+		{pkiBundleFile, "KEY\nCERT\nISSUER\nROOT\n", 0600},
+	}
+	for _, file := range want {
+		path := filepath.Join(dir, file.name)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s wasn't written: %s", file.name, err)
+			continue
+		}
+		if string(content) != file.content {
+			t.Errorf("%s = %q, want %q", file.name, content, file.content)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		if info.Mode().Perm() != file.perm {
+			t.Errorf("%s mode = %s, want %s", file.name, info.Mode().Perm(), file.perm)
+		}
+	}
+
+	other, _ := newV2Secret("OTHER_TLS", []byte(`{"type":"pki","path":"pki/issue/other","dir":"`+dir+`","common_name":"other"}`))
+	other.dynamic.fields = secret.dynamic.fields
+	if err := writePKIFiles([]Secret{secret, other}); err == nil || !strings.Contains(err.Error(), "TLS already writes") {
+		t.Errorf("writePKIFiles() error = %v, want one for two certificates in the same dir", err)
+	}
+}
+
+func TestShutdownKeepsCertificates(t *testing.T) {
+	vault := newFakeLeaseVault(map[string]fakeResponse{"/v1/" + revokeLeasePath: {204, ""}})
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	r := newTestRenewer(server, nil, vaultLease{})
+
+	certificate := newTrackedLease("", "pki/issue/internal", vaultLease{ID: "pki/issue/internal/c1", Duration: time.Hour})
+	certificate.group = &secretGroup{path: "pki/issue/internal", params: map[string]interface{}{"common_name": "app"}}
+	credentials := newTrackedLease("", "database/creds/app", vaultLease{ID: "database/creds/app/l1", Renewable: true, Duration: time.Hour})
+	credentials.group = &secretGroup{path: "database/creds/app"}
+	r.leases = []*trackedLease{certificate, credentials}
+
+	r.shutdown()
+	if got := vault.count("/v1/" + revokeLeasePath); got != 1 {
+		t.Fatalf("shutdown() revoked %d lease(s), want 1", got)
+	}
+	if got := vault.field("/v1/"+revokeLeasePath, "lease_id"); got != "database/creds/app/l1" {
+		t.Errorf("shutdown() revoked %v, want only database/creds/app/l1", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// formatValue renders a decoded JSON value for an environment variable.
+// Scalars are printed the way `vault kv get -field` prints them: strings
+// as-is, numbers exactly as written and booleans as true/false. Objects and
+// arrays are rendered as compact JSON.
+func formatValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		buffer := &bytes.Buffer{}
+		encoder := json.NewEncoder(buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return "", fmt.Errorf("failed to render value as JSON: %s", err.Error())
+		}
+		return strings.TrimSuffix(buffer.String(), "\n"), nil
+	}
+}
+
+// parseSelector splits a selector into the object keys and array indices it
+// walks through. Two syntaxes are accepted:
+//
+//   - JSON pointers (RFC 6901): "/db/hosts/0"
+//   - JSONPath-style expressions: "$.db.hosts[0]" or "$['db']['hosts'][0]"
+//
+// "$" on its own selects the whole value.
+func parseSelector(selector string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(selector, "/"):
+		tokens := strings.Split(selector[1:], "/")
+		for i, token := range tokens {
+			tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		}
+		return tokens, nil
+	case strings.HasPrefix(selector, "$"):
+		return parseJSONPath(selector)
+	default:
+		return nil, fmt.Errorf("selector '%s' must be a JSON pointer starting with '/' or a JSONPath starting with '$'", selector)
+	}
+}
+
+func parseJSONPath(selector string) ([]string, error) {
+	tokens := []string{}
+	rest := selector[1:]
+
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("selector '%s' has an empty field name", selector)
+			}
+			tokens = append(tokens, rest[1:end+1])
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("selector '%s' has an unterminated '['", selector)
+			}
+			token := rest[1:end]
+			if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0] {
+				token = token[1 : len(token)-1]
+			} else if _, err := strconv.Atoi(token); err != nil {
+				return nil, fmt.Errorf("selector '%s' has an invalid index '%s'", selector, token)
+			}
+			tokens = append(tokens, token)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("selector '%s' has unexpected character '%c'", selector, rest[0])
+		}
+	}
+	return tokens, nil
+}
+
+// selectValue walks value along selector and returns what it points at.
+func selectValue(value interface{}, selector string) (interface{}, error) {
+	tokens, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, ok := v[token]
+			if !ok {
+				return nil, NewSecretNotFoundError(fmt.Sprintf("no field '%s' for selector %s", token, selector))
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, NewSecretNotFoundError(fmt.Sprintf("no index '%s' for selector %s", token, selector))
+			}
+			value = v[index]
+		default:
+			return nil, fmt.Errorf("can't select '%s' from a scalar value for selector %s", token, selector)
+		}
+	}
+	return value, nil
+}
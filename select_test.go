@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		want     []string
+		wantErr  string
+	}{
+		{name: "JSON pointer", selector: "/db/hosts/0", want: []string{"db", "hosts", "0"}},
+		{name: "JSON pointer escapes", selector: "/a~1b/c~0d", want: []string{"a/b", "c~d"}},
+		{name: "JSON pointer escaped tilde before 1", selector: "/~01", want: []string{"~1"}},
+		{name: "JSON pointer to an empty key", selector: "/", want: []string{""}},
+		{name: "whole value", selector: "$", want: []string{}},
+		{name: "JSONPath", selector: "$.db.hosts[0]", want: []string{"db", "hosts", "0"}},
+		{name: "no prefix", selector: "db.hosts", wantErr: "must be a JSON pointer starting with '/' or a JSONPath starting with '$'"},
+		{name: "empty", selector: "", wantErr: "must be a JSON pointer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSelector(tt.selector)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSelector(%q) error = %v, want it to contain %q", tt.selector, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSelector(%q) error = %v", tt.selector, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSelector(%q) = %q, want %q", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		want     []string
+		wantErr  string
+	}{
+		{name: "dotted fields", selector: "$.db.host", want: []string{"db", "host"}},
+		{name: "single-quoted brackets", selector: "$['db']['host']", want: []string{"db", "host"}},
+		{name: "double-quoted brackets", selector: `$["db"]["host"]`, want: []string{"db", "host"}},
+		{name: "quoted key with a dot", selector: "$['db.primary'].host", want: []string{"db.primary", "host"}},
+		{name: "array indices", selector: "$.hosts[0][12]", want: []string{"hosts", "0", "12"}},
+		{name: "index then field", selector: "$[1].name", want: []string{"1", "name"}},
+		{name: "empty field name", selector: "$..db", wantErr: "has an empty field name"},
+		{name: "trailing dot", selector: "$.db.", wantErr: "has an empty field name"},
+		{name: "unterminated bracket", selector: "$.hosts[0", wantErr: "has an unterminated '['"},
+		{name: "unquoted key in brackets", selector: "$[db]", wantErr: "has an invalid index 'db'"},
+		{name: "mismatched quotes", selector: `$['db"]`, wantErr: "has an invalid index"},
+		{name: "missing dot", selector: "$db", wantErr: "has unexpected character 'd'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJSONPath(tt.selector)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseJSONPath(%q) error = %v, want it to contain %q", tt.selector, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJSONPath(%q) error = %v", tt.selector, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJSONPath(%q) = %q, want %q", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+// decodeJSON decodes data the way secrets are decoded, with numbers kept as
+// written.
+func decodeJSON(t *testing.T, data string) interface{} {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("failed to decode %s: %s", data, err)
+	}
+	return value
+}
+
+func TestSelectValue(t *testing.T) {
+	data := decodeJSON(t, `{"db":{"host":"db.internal","port":5432,"tls":true,"hosts":["a","b"],"a/b":"slash","c~d":"tilde"},"ratio":1.50}`)
+
+	tests := []struct {
+		name         string
+		selector     string
+		want         string
+		wantNotFound bool
+		wantErr      string
+	}{
+		{name: "string", selector: "/db/host", want: "db.internal"},
+		{name: "number as written", selector: "$.ratio", want: "1.50"},
+		{name: "integer", selector: "$['db']['port']", want: "5432"},
+		{name: "boolean", selector: "/db/tls", want: "true"},
+		{name: "array element", selector: "$.db.hosts[1]", want: "b"},
+		{name: "array element by pointer", selector: "/db/hosts/0", want: "a"},
+		{name: "escaped pointer keys", selector: "/db/a~1b", want: "slash"},
+		{name: "escaped tilde", selector: "/db/c~0d", want: "tilde"},
+		{name: "nested array", selector: "/db/hosts", want: `["a","b"]`},
+		{name: "whole value", selector: "$", want: `{"db":{"a/b":"slash","c~d":"tilde","host":"db.internal","hosts":["a","b"],"port":5432,"tls":true},"ratio":1.50}`},
+		{name: "missing field", selector: "$.db.user", wantNotFound: true, wantErr: "no field 'user'"},
+		{name: "index out of range", selector: "$.db.hosts[2]", wantNotFound: true, wantErr: "no index '2'"},
+		{name: "field of an array", selector: "/db/hosts/first", wantNotFound: true, wantErr: "no index 'first'"},
+		{name: "field of a scalar", selector: "$.db.host.name", wantErr: "can't select 'name' from a scalar value"},
+		{name: "invalid selector", selector: "db.host", wantErr: "must be a JSON pointer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := selectValue(data, tt.selector)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectValue(%q) error = %v, want it to contain %q", tt.selector, err, tt.wantErr)
+				}
+				if _, notFound := err.(SecretNotFoundError); notFound != tt.wantNotFound {
+					t.Errorf("selectValue(%q) error is a %T, want a SecretNotFoundError: %t", tt.selector, err, tt.wantNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectValue(%q) error = %v", tt.selector, err)
+			}
+			got, err := formatValue(value)
+			if err != nil {
+				t.Fatalf("formatValue() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("selectValue(%q) = %s, want %s", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "null", value: `null`, want: ""},
+		{name: "string", value: `"s3cr3t"`, want: "s3cr3t"},
+		{name: "empty string", value: `""`, want: ""},
+		{name: "integer", value: `42`, want: "42"},
+		{name: "large integer", value: `12345678901234567890`, want: "12345678901234567890"},
+		{name: "decimal as written", value: `1.50`, want: "1.50"},
+		{name: "exponent as written", value: `1e3`, want: "1e3"},
+		{name: "true", value: `true`, want: "true"},
+		{name: "false", value: `false`, want: "false"},
+		{name: "object as compact JSON", value: `{ "b": 1, "a": [true, null] }`, want: `{"a":[true,null],"b":1}`},
+		{name: "HTML is not escaped", value: `{"url":"https://example.com/?a=1&b=<2>"}`, want: `{"url":"https://example.com/?a=1&b=<2>"}`},
+		{name: "nested array", value: `[[1, 2], {"k": "v"}]`, want: `[[1,2],{"k":"v"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatValue(decodeJSON(t, tt.value))
+			if err != nil {
+				t.Fatalf("formatValue(%s) error = %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("formatValue(%s) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The SPIFFE Workload API is a gRPC service, and pulling in a gRPC stack
+// would be most of this binary's size. FetchJWTSVID is a single unary call,
+// so this file speaks just enough HTTP/2 and protobuf to make it: one stream,
+// uncompressed literal headers, and a response read until the stream ends.
+
+const (
+	spiffeTimeout       = 10 * time.Second
+	fetchJWTSVIDPath    = "/SpiffeWorkloadAPI/FetchJWTSVID"
+	http2ClientPreface  = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2FrameHeaderLen = 9
+	http2MaxFrameSize   = 1 << 14
+	http2FrameData      = 0x0
+	http2FrameHeaders   = 0x1
+	http2FrameRSTStream = 0x3
+	http2FrameSettings  = 0x4
+	http2FramePing      = 0x6
+	http2FrameGoAway    = 0x7
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	workloadAPIStreamID = 1
+)
+
+// fetchJWTSVID asks the Workload API at endpoint for a JWT-SVID for audience
+// and returns the first one it gets.
+func fetchJWTSVID(endpoint, audience string) (string, error) {
+	network, address, err := parseSPIFFEEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.DialTimeout(network, address, spiffeTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the SPIFFE Workload API at %s: %s", endpoint, err.Error())
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(spiffeTimeout)); err != nil {
+		return "", err
+	}
+
+	if err := writeJWTSVIDRequest(conn, audience); err != nil {
+		return "", fmt.Errorf("failed to send JWT-SVID request: %s", err.Error())
+	}
+	message, err := readGRPCResponse(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read JWT-SVID response: %s", err.Error())
+	}
+
+	svid, err := parseJWTSVIDResponse(message)
+	if err != nil {
+		return "", err
+	}
+	return svid, nil
+}
+
+// parseSPIFFEEndpoint splits a SPIFFE_ENDPOINT_SOCKET value, either
+// `unix:///path/to/socket` or `tcp://host:port`.
+func parseSPIFFEEndpoint(endpoint string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		return "unix", strings.TrimPrefix(endpoint, "unix://"), nil
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return "tcp", strings.TrimPrefix(endpoint, "tcp://"), nil
+	default:
+		return "", "", fmt.Errorf("invalid SPIFFE endpoint '%s': must start with unix:// or tcp://", endpoint)
+	}
+}
+
+func writeJWTSVIDRequest(w io.Writer, audience string) error {
+	var headers bytes.Buffer
+	for _, field := range [][2]string{
+		{":method", "POST"},
+		{":scheme", "http"},
+		{":path", fetchJWTSVIDPath},
+		{":authority", "localhost"},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+		// The Workload API rejects calls without this header, to keep
+		// browsers from reaching it through SSRF.
+		{"workload.spiffe.io", "true"},
+	} {
+		writeHPACKLiteral(&headers, field[0], field[1])
+	}
+
+	// JWTSVIDRequest{audience: [audience]}
+	var request bytes.Buffer
+	writeProtoString(&request, 1, audience)
+
+	message := make([]byte, 5, 5+request.Len())
+	binary.BigEndian.PutUint32(message[1:], uint32(request.Len()))
+	message = append(message, request.Bytes()...)
+
+	if _, err := io.WriteString(w, http2ClientPreface); err != nil {
+		return err
+	}
+	if err := writeHTTP2Frame(w, http2FrameSettings, 0, 0, nil); err != nil {
+		return err
+	}
+	if err := writeHTTP2Frame(w, http2FrameHeaders, http2FlagEndHeaders, workloadAPIStreamID, headers.Bytes()); err != nil {
+		return err
+	}
+	return writeHTTP2Frame(w, http2FrameData, http2FlagEndStream, workloadAPIStreamID, message)
+}
+
+// readGRPCResponse reads frames until the request's stream ends and returns
+// the gRPC message carried in its DATA frames. Response headers and trailers
+// aren't decoded; a call that fails simply carries no message.
+func readGRPCResponse(rw io.ReadWriter) ([]byte, error) {
+	var data bytes.Buffer
+	header := make([]byte, http2FrameHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(rw, header); err != nil {
+			return nil, err
+		}
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frameType, flags := header[3], header[4]
+		streamID := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+		if length > http2MaxFrameSize {
+			return nil, fmt.Errorf("frame of %d bytes exceeds the maximum frame size", length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(rw, payload); err != nil {
+			return nil, err
+		}
+
+		switch frameType {
+		case http2FrameSettings:
+			if flags&http2FlagAck == 0 {
+				if err := writeHTTP2Frame(rw, http2FrameSettings, http2FlagAck, 0, nil); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case http2FramePing:
+			if flags&http2FlagAck == 0 {
+				if err := writeHTTP2Frame(rw, http2FramePing, http2FlagAck, 0, payload); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case http2FrameGoAway:
+			return nil, errors.New("the Workload API closed the connection")
+		}
+
+		if streamID != workloadAPIStreamID {
+			continue
+		}
+		switch frameType {
+		case http2FrameRSTStream:
+			if len(payload) < 4 {
+				return nil, errors.New("the Workload API reset the stream")
+			}
+			return nil, fmt.Errorf("the Workload API reset the stream with error code %d", binary.BigEndian.Uint32(payload))
+		case http2FrameData:
+			if flags&http2FlagPadded != 0 && len(payload) > 0 {
+				padding := int(payload[0])
+				if padding >= len(payload) {
+					return nil, errors.New("malformed padded DATA frame")
+				}
+				payload = payload[1 : len(payload)-padding]
+			}
+			data.Write(payload)
+		}
+		if flags&http2FlagEndStream != 0 {
+			break
+		}
+	}
+
+	message := data.Bytes()
+	if len(message) < 5 {
+		return nil, errors.New("the Workload API returned no JWT-SVID; check that this workload has a registration entry")
+	}
+	if message[0] != 0 {
+		return nil, errors.New("the Workload API returned a compressed message")
+	}
+	size := binary.BigEndian.Uint32(message[1:5])
+	if int(size) > len(message)-5 {
+		return nil, errors.New("the Workload API returned a truncated message")
+	}
+	return message[5 : 5+size], nil
+}
+
+// parseJWTSVIDResponse returns the first token of a JWTSVIDResponse
+// {repeated JWTSVID svids = 1}, where JWTSVID is {string spiffe_id = 1;
+// string svid = 2}.
+func parseJWTSVIDResponse(message []byte) (string, error) {
+	for len(message) > 0 {
+		field, value, rest, err := readProtoField(message)
+		if err != nil {
+			return "", fmt.Errorf("malformed JWT-SVID response: %s", err.Error())
+		}
+		message = rest
+		if field != 1 {
+			continue
+		}
+
+		svid := value
+		for len(svid) > 0 {
+			svidField, svidValue, svidRest, err := readProtoField(svid)
+			if err != nil {
+				return "", fmt.Errorf("malformed JWT-SVID response: %s", err.Error())
+			}
+			svid = svidRest
+			if svidField == 2 {
+				return string(svidValue), nil
+			}
+		}
+	}
+	return "", errors.New("the Workload API returned no JWT-SVID")
+}
+
+func writeHTTP2Frame(w io.Writer, frameType, flags byte, streamID uint32, payload []byte) error {
+	frame := make([]byte, http2FrameHeaderLen, http2FrameHeaderLen+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = frameType, flags
+	binary.BigEndian.PutUint32(frame[5:], streamID)
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// writeHPACKLiteral encodes a "literal header field without indexing - new
+// name" with plain, non-Huffman strings (RFC 7541, section 6.2.2).
+func writeHPACKLiteral(buffer *bytes.Buffer, name, value string) {
+	buffer.WriteByte(0)
+	for _, s := range []string{name, value} {
+		writeHPACKInteger(buffer, 7, uint64(len(s)))
+		buffer.WriteString(s)
+	}
+}
+
+func writeHPACKInteger(buffer *bytes.Buffer, prefixBits uint, value uint64) {
+	limit := uint64(1)<<prefixBits - 1
+	if value < limit {
+		buffer.WriteByte(byte(value))
+		return
+	}
+	buffer.WriteByte(byte(limit))
+	value -= limit
+	for value >= 0x80 {
+		buffer.WriteByte(byte(value&0x7f | 0x80))
+		value >>= 7
+	}
+	buffer.WriteByte(byte(value))
+}
+
+func writeProtoString(buffer *bytes.Buffer, field uint64, value string) {
+	var scratch [binary.MaxVarintLen64]byte
+	buffer.Write(scratch[:binary.PutUvarint(scratch[:], field<<3|2)])
+	buffer.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(value)))])
+	buffer.WriteString(value)
+}
+
+// readProtoField reads one field from a protobuf message. Only the value of
+// length-delimited fields is returned; other wire types are skipped.
+func readProtoField(message []byte) (uint64, []byte, []byte, error) {
+	key, n := binary.Uvarint(message)
+	if n <= 0 {
+		return 0, nil, nil, errors.New("invalid field key")
+	}
+	message = message[n:]
+	field, wireType := key>>3, key&0x7
+
+	switch wireType {
+	case 0:
+		if _, n = binary.Uvarint(message); n <= 0 {
+			return 0, nil, nil, errors.New("invalid varint")
+		}
+		return field, nil, message[n:], nil
+	case 1:
+		if len(message) < 8 {
+			return 0, nil, nil, errors.New("truncated fixed64")
+		}
+		return field, nil, message[8:], nil
+	case 2:
+		length, n := binary.Uvarint(message)
+		if n <= 0 || length > uint64(len(message)-n) {
+			return 0, nil, nil, errors.New("invalid length")
+		}
+		message = message[n:]
+		return field, message[:length], message[length:], nil
+	case 5:
+		if len(message) < 4 {
+			return 0, nil, nil, errors.New("truncated fixed32")
+		}
+		return field, nil, message[4:], nil
+	default:
+		return 0, nil, nil, fmt.Errorf("unsupported wire type %d", wireType)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Responses to FetchJWTSVID captured from Go's net/http HTTP/2 server
+// answering as the Workload API does, one frame per line: the server's
+// SETTINGS, its ACK of ours and a WINDOW_UPDATE, then the stream's frames.
+// The headers are HPACK-encoded with Huffman strings and indexed fields.
+var (
+	capturedJWTSVIDResponse = "" +
+		"000024040000000000" + "0005001000000003000000fa000600100140000100001000000400100000000900000001" +
+		"000000040100000000" +
+		"000004080000000000" + "000f0001" +
+		// HEADERS :status 200, content-type application/grpc, trailer
+		"000045010400000001" + "885f8b1d75d0620d263d4c4d656440854d833505b393c565645b72469b51f4a62b2b22da0a840e62ff5c0239396196dc34fd281754d444a82009c500ddc699b806d4c5a37f" +
+		"000063000000000001" + "000000005e" + capturedJWTSVIDMessage +
+		// HEADERS grpc-status 0, END_STREAM
+		"000018010500000001" + "40889acac8b21234da8f013040899acac8b5254207317f00"
+
+	// A trailers-only response: grpc-status 7 (PermissionDenied), "no
+	// identity issued", as for a workload without a registration entry.
+	capturedJWTSVIDDenied = "" +
+		"000024040000000000" + "0005001000000003000000fa000600100140000100001000000400100000000900000001" +
+		"000000040100000000" +
+		"000004080000000000" + "000f0001" +
+		"00004e010500000001" + "885f8b1d75d0620d263d4c4d656440899acac8b5254207317f8da8ea1a42d49327d286422d2c9f40889acac8b21234da8f01375c01306196dc34fd281754d444a82009c500ddc699b806d4c5a37f"
+
+	// JWTSVIDResponse{svids: [{spiffe_id: "spiffe://example.org/workload",
+	// svid: capturedJWTSVID, hint: "external"}]}
+	capturedJWTSVIDMessage = "" +
+		"0a5c" +
+		"0a1d" + "7370696666653a2f2f6578616d706c652e6f72672f776f726b6c6f6164" +
+		"1231" + "65794a68624763694f694a46557a49314e694a392e65794a68645751694f6c7369646d4631624851695858302e63326c6e" +
+		"1a08" + "65787465726e616c"
+	capturedJWTSVID = "eyJhbGciOiJFUzI1NiJ9.eyJhdWQiOlsidmF1bHQiXX0.c2ln"
+)
+
+type fakeWorkloadConn struct {
+	*bytes.Reader
+	written bytes.Buffer
+}
+
+func (c *fakeWorkloadConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
+
+func http2Frame(frameType, flags byte, streamID uint32, payload []byte) string {
+	var frame bytes.Buffer
+	writeHTTP2Frame(&frame, frameType, flags, streamID, payload)
+	return hex.EncodeToString(frame.Bytes())
+}
+
+// grpcMessage frames message as an uncompressed gRPC message.
+func grpcMessage(message string) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+}
+
+func TestReadGRPCResponse(t *testing.T) {
+	headers := http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, nil)
+	trailers := http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, nil)
+
+	tests := []struct {
+		name    string
+		frames  string
+		want    string
+		acks    string
+		wantErr string
+	}{
+		{
+			name:   "captured response",
+			frames: capturedJWTSVIDResponse,
+			want:   capturedJWTSVIDMessage,
+			acks:   http2Frame(http2FrameSettings, http2FlagAck, 0, nil),
+		},
+		{
+			name:    "captured trailers-only error",
+			frames:  capturedJWTSVIDDenied,
+			wantErr: "returned no JWT-SVID",
+		},
+		{
+			name: "message split across DATA frames with a PING between",
+			frames: headers +
+				http2Frame(http2FrameData, 0, 1, grpcMessage("hello")[:3]) +
+				http2Frame(http2FramePing, 0, 0, []byte("12345678")) +
+				http2Frame(http2FrameData, 0, 1, grpcMessage("hello")[3:]) +
+				trailers,
+			want: hex.EncodeToString([]byte("hello")),
+			acks: http2Frame(http2FramePing, http2FlagAck, 0, []byte("12345678")),
+		},
+		{
+			name: "padded DATA frame",
+			frames: headers +
+				http2Frame(http2FrameData, http2FlagPadded|http2FlagEndStream, 1, append(append([]byte{3}, grpcMessage("hello")...), 0, 0, 0)),
+			want: hex.EncodeToString([]byte("hello")),
+		},
+		{
+			name: "frames on other streams are ignored",
+			frames: http2Frame(http2FrameData, http2FlagEndStream, 3, grpcMessage("other")) +
+				headers +
+				http2Frame(http2FrameData, http2FlagEndStream, 1, grpcMessage("hello")),
+			want: hex.EncodeToString([]byte("hello")),
+		},
+		{
+			name:    "padding longer than the frame",
+			frames:  http2Frame(http2FrameData, http2FlagPadded, 1, []byte{5, 0, 0}),
+			wantErr: "malformed padded DATA frame",
+		},
+		{
+			name:    "stream reset",
+			frames:  headers + http2Frame(http2FrameRSTStream, 0, 1, []byte{0, 0, 0, 8}),
+			wantErr: "reset the stream with error code 8",
+		},
+		{
+			name:    "connection closed",
+			frames:  http2Frame(http2FrameGoAway, 0, 0, []byte{0, 0, 0, 0, 0, 0, 0, 0}),
+			wantErr: "closed the connection",
+		},
+		{
+			name:    "frame over the maximum size",
+			frames:  "004001000000000001",
+			wantErr: "exceeds the maximum frame size",
+		},
+		{
+			name:    "compressed message",
+			frames:  http2Frame(http2FrameData, http2FlagEndStream, 1, append([]byte{1}, grpcMessage("hello")[1:]...)),
+			wantErr: "compressed message",
+		},
+		{
+			name:    "truncated message",
+			frames:  http2Frame(http2FrameData, http2FlagEndStream, 1, grpcMessage("hello")[:8]),
+			wantErr: "truncated message",
+		},
+		{
+			name:    "connection ends before the stream",
+			frames:  headers + http2Frame(http2FrameData, 0, 1, grpcMessage("hello")),
+			wantErr: "EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeWorkloadConn{Reader: bytes.NewReader(decodeHex(t, tt.frames))}
+			got, err := readGRPCResponse(conn)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readGRPCResponse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readGRPCResponse() error = %v", err)
+			}
+			if want := decodeHex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("readGRPCResponse() = %x, want %x", got, want)
+			}
+			if acks := decodeHex(t, tt.acks); !bytes.Equal(conn.written.Bytes(), acks) {
+				t.Errorf("readGRPCResponse() wrote %x, want %x", conn.written.Bytes(), acks)
+			}
+		})
+	}
+}
+
+func TestReadProtoField(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		wantField uint64
+		wantValue string
+		wantRest  string
+		wantErr   string
+	}{
+		{name: "length-delimited", message: "0a03616263ff", wantField: 1, wantValue: "616263", wantRest: "ff"},
+		{name: "empty length-delimited", message: "1200", wantField: 2},
+		{name: "varint", message: "18ac02ff", wantField: 3, wantRest: "ff"},
+		{name: "fixed64", message: "210102030405060708ff", wantField: 4, wantRest: "ff"},
+		{name: "fixed32", message: "2d01020304ff", wantField: 5, wantRest: "ff"},
+		{name: "multi-byte key", message: "820101ab", wantField: 16, wantValue: "ab"},
+		{name: "empty message", message: "", wantErr: "invalid field key"},
+		{name: "truncated key", message: "80", wantErr: "invalid field key"},
+		{name: "truncated varint", message: "1880", wantErr: "invalid varint"},
+		{name: "truncated fixed64", message: "2101020304", wantErr: "truncated fixed64"},
+		{name: "truncated fixed32", message: "2d0102", wantErr: "truncated fixed32"},
+		{name: "length past the end", message: "0a0561", wantErr: "invalid length"},
+		{name: "start group", message: "0b", wantErr: "unsupported wire type 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, value, rest, err := readProtoField(decodeHex(t, tt.message))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readProtoField() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProtoField() error = %v", err)
+			}
+			if field != tt.wantField {
+				t.Errorf("readProtoField() field = %d, want %d", field, tt.wantField)
+			}
+			if want := decodeHex(t, tt.wantValue); !bytes.Equal(value, want) {
+				t.Errorf("readProtoField() value = %x, want %x", value, want)
+			}
+			if want := decodeHex(t, tt.wantRest); !bytes.Equal(rest, want) {
+				t.Errorf("readProtoField() rest = %x, want %x", rest, want)
+			}
+		})
+	}
+}
+
+func TestParseJWTSVIDResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		wantErr string
+	}{
+		{name: "captured response", message: capturedJWTSVIDMessage, want: capturedJWTSVID},
+		{
+			name: "first of several SVIDs",
+			// {svids: [{spiffe_id: "a", svid: "one"}, {svid: "two"}]}
+			message: "0a08" + "0a0161" + "12036f6e65" + "0a05" + "120374776f",
+			want:    "one",
+		},
+		{
+			name: "unknown fields are skipped",
+			// {2: 7, svids: [{4: 1, svid: "one"}]}
+			message: "1007" + "0a07" + "2001" + "12036f6e65",
+			want:    "one",
+		},
+		{name: "no SVIDs", message: "", wantErr: "returned no JWT-SVID"},
+		{name: "SVID without a token", message: "0a03" + "0a0161", wantErr: "returned no JWT-SVID"},
+		{name: "malformed response", message: "0a05" + "0a0161", wantErr: "malformed JWT-SVID response"},
+		{name: "malformed SVID", message: "0a03" + "120561", wantErr: "malformed JWT-SVID response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJWTSVIDResponse(decodeHex(t, tt.message))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseJWTSVIDResponse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWTSVIDResponse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseJWTSVIDResponse() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
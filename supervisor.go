@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	secretFetcherSupervise = "FETCHER_SUPERVISE"
+	// reraiseGracePeriod is how long to wait for a signal re-raised on the
+	// fetcher to end it before falling back to an exit code. It doesn't end
+	// PID 1, which the kernel never kills with signals it doesn't handle.
+	reraiseGracePeriod = 100 * time.Millisecond
+)
+
+// supervisor runs the entrypoint as a child process instead of exec'ing it,
+// so the fetcher keeps running alongside the application.
+type supervisor struct {
+	cmd     *exec.Cmd
+	signals chan os.Signal
+}
+
+// startSupervisor starts the entrypoint given on the command line with env,
+// which holds the secrets.
+func startSupervisor(env entrypointEnv) *supervisor {
+	flag.Parse()
+
+	path, err := exec.LookPath(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Fatal error: startSupervisor() failed to locate the entrypoint '%s' - %s", flag.Arg(0), err)
+	}
+
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   flag.Args(),
+		Env:    env.environ(),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	// Listen before starting the child so neither a signal meant for it nor
+	// its exit can be missed.
+	s := &supervisor{cmd: cmd, signals: make(chan os.Signal, 32)}
+	signal.Notify(s.signals)
+
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Fatal error: startSupervisor() failed to start the entrypoint '%s' - %s", path, err)
+	}
+	log.Printf("INFO: supervising entrypoint '%s' (pid %d)", path, cmd.Process.Pid)
+	return s
+}
+
+// signal sends sig to the entrypoint.
+func (s *supervisor) signal(sig os.Signal) error {
+	return s.cmd.Process.Signal(sig)
+}
+
+// stop asks the entrypoint to exit with SIGTERM and kills it if it's still
+// running after grace.
+func (s *supervisor) stop(grace time.Duration) {
+	if err := s.signal(syscall.SIGTERM); err != nil {
+		log.Printf("WARN: failed to send SIGTERM to the entrypoint: %s", err.Error())
+	}
+	time.AfterFunc(grace, func() {
+		if err := s.signal(syscall.SIGKILL); err == nil {
+			log.Printf("WARN: entrypoint didn't exit within %s of SIGTERM, killed it", grace)
+		}
+	})
+}
+
+// wait forwards the signals the fetcher receives to the entrypoint and reaps
+// exited processes until the entrypoint exits, then returns its status.
+// Running as PID 1, the fetcher also inherits every orphaned descendant of
+// the entrypoint, which have to be reaped for their process table entries to
+// be freed.
+func (s *supervisor) wait() syscall.WaitStatus {
+	for {
+		switch sig := <-s.signals; sig {
+		case syscall.SIGCHLD:
+			if status, exited := s.reap(); exited {
+				signal.Stop(s.signals)
+				return status
+			}
+		case syscall.SIGURG:
+			// Used by the Go runtime to preempt goroutines, not meant for
+			// the entrypoint.
+		default:
+			if err := s.signal(sig); err != nil {
+				log.Printf("WARN: failed to forward %s to the entrypoint: %s", sig, err.Error())
+			}
+		}
+	}
+}
+
+// reap collects every process that has exited and reports whether the
+// entrypoint is one of them.
+func (s *supervisor) reap() (syscall.WaitStatus, bool) {
+	var entrypointStatus syscall.WaitStatus
+	exited := false
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return entrypointStatus, exited
+		}
+		if pid == s.cmd.Process.Pid {
+			entrypointStatus, exited = status, true
+		} else if debugMode {
+			log.Printf("DEBUG: reaped orphaned process %d", pid)
+		}
+	}
+}
+
+// exitLike ends the fetcher the way the entrypoint ended: with its exit code,
+// or by the signal that killed it.
+func exitLike(status syscall.WaitStatus) {
+	if status.Signaled() {
+		sig := status.Signal()
+		log.Printf("INFO: entrypoint was killed by %s", sig)
+		signal.Reset(sig)
+		if err := syscall.Kill(os.Getpid(), sig); err == nil {
+			time.Sleep(reraiseGracePeriod)
+		}
+		os.Exit(128 + int(sig))
+	}
+
+	log.Printf("INFO: entrypoint exited with code %d", status.ExitStatus())
+	os.Exit(status.ExitStatus())
+}
+
+// Supervise runs the entrypoint as a child process with env, keeping the
+// token and leases alive with r and watching its secrets for changes when w
+// isn't nil, and exits with its status once it ends. The token and leases are still
+// needed while the entrypoint runs, so they are only revoked then.
+func Supervise(env entrypointEnv, w *watcher, r *renewer, revokeToken bool) {
+	s := startSupervisor(env)
+	r.run()
+	if w != nil {
+		go w.run(s)
+	}
+
+	status := s.wait()
+	r.shutdown()
+	if revokeToken {
+		RevokeToken()
+	}
+	exitLike(status)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// prSetChildSubreaper makes orphaned descendants be reparented to the
+// calling process rather than to PID 1, as they are to the fetcher in a
+// container.
+const prSetChildSubreaper = 36
+
+// TestSupervisorHelperProcess isn't a real test. It is run by the tests
+// below, in the style of os/exec's helper processes, as a fetcher that
+// supervises the script given after `--`, and exits like it.
+func TestSupervisorHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_SUPERVISOR_HELPER") != "1" {
+		return
+	}
+	syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	s := startSupervisor(newEntrypointEnv())
+	exitLike(s.wait())
+}
+
+// startSupervisorHelper starts a fetcher that supervises `sh -c script` and
+// returns it with the entrypoint's standard output.
+func startSupervisorHelper(t *testing.T, script string) (*exec.Cmd, *bufio.Reader) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSupervisorHelperProcess$", "--", "sh", "-c", script)
+	cmd.Env = append(os.Environ(), "GO_WANT_SUPERVISOR_HELPER=1")
+	cmd.Stderr = ioutil.Discard
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to get the helper's stdout: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start the helper: %s", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return cmd, bufio.NewReader(stdout)
+}
+
+// readLine reads a line the entrypoint wrote.
+func readLine(t *testing.T, stdout *bufio.Reader) string {
+	t.Helper()
+	line, err := stdout.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read the entrypoint's output: %s", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+// waitStatus waits for the helper to exit and returns how it ended.
+func waitStatus(t *testing.T, cmd *exec.Cmd, stdout io.Reader) syscall.WaitStatus {
+	t.Helper()
+	io.Copy(ioutil.Discard, stdout)
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the helper didn't exit")
+	}
+	return cmd.ProcessState.Sys().(syscall.WaitStatus)
+}
+
+func TestSuperviseExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantCode   int
+		wantSignal syscall.Signal
+	}{
+		{name: "success", script: "exit 0", wantCode: 0},
+		{name: "exit code", script: "exit 7", wantCode: 7},
+		{name: "killed by SIGTERM", script: "kill -TERM $$", wantSignal: syscall.SIGTERM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, stdout := startSupervisorHelper(t, tt.script)
+			status := waitStatus(t, cmd, stdout)
+
+			if tt.wantSignal != 0 {
+				// The signal is re-raised on the fetcher; as PID 1, which
+				// it can't kill, it exits with 128 + the signal instead.
+				if status.Signaled() && status.Signal() == tt.wantSignal {
+					return
+				}
+				if status.Exited() && status.ExitStatus() == 128+int(tt.wantSignal) {
+					return
+				}
+				t.Fatalf("fetcher ended with %v, want to be killed by %s", cmd.ProcessState, tt.wantSignal)
+			}
+			if !status.Exited() || status.ExitStatus() != tt.wantCode {
+				t.Fatalf("fetcher ended with %v, want exit code %d", cmd.ProcessState, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSuperviseForwardsSignals(t *testing.T) {
+	cmd, stdout := startSupervisorHelper(t, `trap "exit 42" USR1; echo ready; while :; do sleep 0.05; done`)
+	if line := readLine(t, stdout); line != "ready" {
+		t.Fatalf("entrypoint wrote %q, want ready", line)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf("failed to signal the fetcher: %s", err)
+	}
+	status := waitStatus(t, cmd, stdout)
+	if !status.Exited() || status.ExitStatus() != 42 {
+		t.Fatalf("fetcher ended with %v, want exit code 42 from the entrypoint's SIGUSR1 trap", cmd.ProcessState)
+	}
+}
+
+func TestSuperviseReapsOrphans(t *testing.T) {
+	// The subshell exits right away, leaving its background sleep to be
+	// adopted by the fetcher.
+	cmd, stdout := startSupervisorHelper(t, `(sleep 0.1 & echo $!); sleep 1`)
+	pid := readLine(t, stdout)
+
+	time.Sleep(500 * time.Millisecond)
+	if stat, err := ioutil.ReadFile("/proc/" + pid + "/stat"); err == nil {
+		t.Errorf("orphaned process %s wasn't reaped: %s", pid, strings.TrimSpace(string(stat)))
+	}
+
+	status := waitStatus(t, cmd, stdout)
+	if !status.Exited() || status.ExitStatus() != 0 {
+		t.Fatalf("fetcher ended with %v, want exit code 0", cmd.ProcessState)
+	}
+}
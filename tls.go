@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertName            = "VAULT_CACERT"
+	caPathName            = "VAULT_CAPATH"
+	tlsServerNameName     = "VAULT_TLS_SERVER_NAME"
+	tlsMinVersionName     = "VAULT_TLS_MIN_VERSION"
+	tlsPinsName           = "VAULT_TLS_PINS"
+	clientCertName        = "VAULT_CLIENT_CERT"
+	clientKeyName         = "VAULT_CLIENT_KEY"
+	clientKeyPasswordName = "VAULT_CLIENT_KEY_PASSWORD"
+	defaultTLSMinVersion  = "tls12"
+	spkiPinPrefix         = "sha256/"
+)
+
+var tlsVersions = map[string]uint16{
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration used to talk to Vault from the
+// VAULT_CACERT, VAULT_CAPATH, VAULT_TLS_* and VAULT_CLIENT_* settings. Any
+// setting that can't be honoured is fatal; falling back to a weaker
+// configuration would hide the misconfiguration.
+func newTLSConfig() *tls.Config {
+	rootCAs, err := loadRootCAs(GetenvSafe(caCertName, false), GetenvSafe(caPathName, false))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err.Error())
+	}
+
+	minVersionName := GetenvSafe(tlsMinVersionName, false)
+	if minVersionName == "" {
+		minVersionName = defaultTLSMinVersion
+	}
+	minVersion, ok := tlsVersions[minVersionName]
+	if !ok {
+		log.Fatalf("ERROR: %s must be one of tls12 or tls13, got '%s'", tlsMinVersionName, minVersionName)
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: GetenvSafe(tlsServerNameName, false),
+		MinVersion: minVersion,
+	}
+
+	if value := GetenvSafe(tlsPinsName, false); value != "" {
+		pins, err := parseSPKIPins(value)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err.Error())
+		}
+		tlsConfig.VerifyPeerCertificate = pins.verify
+	}
+
+	if clientCert := newClientCertificate(); clientCert != nil {
+		tlsConfig.GetClientCertificate = clientCert.get
+	}
+	return tlsConfig
+}
+
+// loadRootCAs returns the CAs Vault's certificate is verified against. Like
+// the Vault CLI, VAULT_CACERT and VAULT_CAPATH replace the system trust store
+// rather than adding to it.
+func loadRootCAs(caCert, caPath string) (*x509.CertPool, error) {
+	if caCert == "" && caPath == "" {
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the system trust store, set %s or %s instead: %s", caCertName, caPathName, err.Error())
+		}
+		return certPool, nil
+	}
+
+	certPool := x509.NewCertPool()
+	if caCert != "" {
+		if err := appendCAFile(certPool, caCert); err != nil {
+			return nil, fmt.Errorf("%s: %s", caCertName, err.Error())
+		}
+	}
+	if caPath != "" {
+		files, err := ioutil.ReadDir(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read CA directory: %s", caPathName, err.Error())
+		}
+		loaded := 0
+		for _, file := range files {
+			// Certificate directories prepared with c_rehash also hold
+			// hash-named symlinks to the same files; Stat follows them.
+			path := filepath.Join(caPath, file.Name())
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+			if err := appendCAFile(certPool, path); err != nil {
+				if debugMode {
+					log.Printf("DEBUG: %s: skipping %s", caPathName, err.Error())
+				}
+				continue
+			}
+			loaded = loaded + 1
+		}
+		if loaded == 0 {
+			return nil, fmt.Errorf("%s: no PEM certificates found in %s", caPathName, caPath)
+		}
+	}
+	return certPool, nil
+}
+
+func appendCAFile(certPool *x509.CertPool, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate %s: %s", path, err.Error())
+	}
+	if !certPool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return nil
+}
+
+// spkiPins are base64-encoded SHA-256 hashes of SubjectPublicKeyInfo, the
+// same format as HPKP pins and `openssl pkey -pubin -outform der | openssl
+// dgst -sha256 -binary | base64`.
+type spkiPins map[string]bool
+
+func parseSPKIPins(value string) (spkiPins, error) {
+	pins := spkiPins{}
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+		if pin == "" {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s: '%s' is not a base64-encoded SHA-256 hash", tlsPinsName, pin)
+		}
+		pins[pin] = true
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("%s is set but contains no pins", tlsPinsName)
+	}
+	return pins, nil
+}
+
+// verify implements tls.Config.VerifyPeerCertificate. It runs after the
+// normal chain verification and accepts the connection when any certificate
+// of a verified chain, leaf or CA, matches a pin.
+func (p spkiPins) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if p[base64.StdEncoding.EncodeToString(hash[:])] {
+				return nil
+			}
+		}
+	}
+	return errors.New("Vault's certificate chain matches none of the pins in " + tlsPinsName)
+}
+
+// clientCertificate is the TLS client keypair presented to Vault. The files
+// are checked on every handshake and the keypair reloaded when either of
+// them changed, so certificates rotated on disk by cert-manager are picked up
+// without restarting.
+type clientCertificate struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	password credentialSource
+	cert     *tls.Certificate
+	loadedAt time.Time
+}
+
+// newClientCertificate loads the keypair configured with VAULT_CLIENT_CERT
+// and VAULT_CLIENT_KEY, or returns nil when no client certificate is
+// configured.
+func newClientCertificate() *clientCertificate {
+	certFile := GetenvSafe(clientCertName, false)
+	keyFile := GetenvSafe(clientKeyName, false)
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		log.Fatalf("ERROR: %s and %s must be set together", clientCertName, clientKeyName)
+	}
+
+	c := &clientCertificate{certFile: certFile, keyFile: keyFile, password: newCredentialSource(clientKeyPasswordName, false)}
+	if _, err := c.get(nil); err != nil {
+		log.Fatalf("ERROR: %s", err.Error())
+	}
+	return c
+}
+
+// get implements tls.Config.GetClientCertificate.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	modified, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Keep using the loaded keypair while the files are being
+			// replaced.
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && modified.Equal(c.loadedAt) {
+		return c.cert, nil
+	}
+
+	cert, err := c.load()
+	if err != nil {
+		if c.cert != nil {
+			log.Printf("WARN: failed to reload client certificate, keeping the previous one: %s", err.Error())
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Printf("INFO: reloaded client certificate from %s", c.certFile)
+	}
+	c.cert, c.loadedAt = cert, modified
+	return c.cert, nil
+}
+
+func (c *clientCertificate) load() (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(c.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate %s: %s", c.certFile, err.Error())
+	}
+	keyPEM, err := ioutil.ReadFile(c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client key %s: %s", c.keyFile, err.Error())
+	}
+	if keyPEM, err = c.decryptKey(keyPEM); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client keypair %s/%s: %s", c.certFile, c.keyFile, err.Error())
+	}
+	return &cert, nil
+}
+
+// decryptKey decrypts a key protected with a password, either as an
+// encrypted PKCS#8 key (`BEGIN ENCRYPTED PRIVATE KEY`) or with legacy PEM
+// encryption (`Proc-Type: 4,ENCRYPTED`), using VAULT_CLIENT_KEY_PASSWORD.
+// Unencrypted keys are returned as they are.
+func (c *clientCertificate) decryptKey(keyPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("client key %s contains no PEM data", c.keyFile)
+	}
+	// Legacy PEM encryption is deprecated as insecure by the standard
+	// library, but it's what `openssl rsa -aes256 -traditional` produces.
+	encryptedPKCS8 := block.Type == "ENCRYPTED PRIVATE KEY"
+	if !encryptedPKCS8 && !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+
+	if !c.password.isSet() {
+		return nil, fmt.Errorf("client key %s is encrypted but %s is not set", c.keyFile, clientKeyPasswordName)
+	}
+	password, err := c.password.load()
+	if err != nil {
+		return nil, err
+	}
+	if encryptedPKCS8 {
+		der, err := decryptPKCS8(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt client key %s: %s", c.keyFile, err.Error())
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.DecryptPEMBlock(block, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt client key %s: %s", c.keyFile, err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	secretFetcherRevokeToken = "FETCHER_REVOKE_TOKEN"
+	revokeSelfPath           = "auth/token/revoke-self"
+	renewSelfPath            = "auth/token/renew-self"
+	lookupSelfPath           = "auth/token/lookup-self"
+)
+
+// revokeTimeout bounds how long revoking the token may hold up the
+// entrypoint when Vault doesn't answer.
+var revokeTimeout = 5 * time.Second
+
+// vaultToken holds the client's token, which is replaced when the fetcher
+// logs in again while other requests are in flight.
+type vaultToken struct {
+	sync.RWMutex
+	value string
+}
+
+func (t *vaultToken) get() string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.value
+}
+
+func (t *vaultToken) set(value string) {
+	t.Lock()
+	defer t.Unlock()
+	t.value = value
+}
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		Renewable     bool   `json:"renewable"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+func (r authResponse) lease() vaultLease {
+	return vaultLease{Renewable: r.Auth.Renewable, Duration: time.Duration(r.Auth.LeaseDuration) * time.Second}
+}
+
+// login logs in with method, makes the client use the token it got and
+// returns the token's lease.
+func (vc *VaultClient) login(method authMethod) (vaultLease, error) {
+	status, body, err := vc.auth(method)
+	if err != nil {
+		return vaultLease{}, fmt.Errorf("failed to reach Vault: %s", err.Error())
+	}
+	if status != 200 {
+		return vaultLease{}, fmt.Errorf("failed to authenticate with Vault - Response code: %d - %s", status, body)
+	}
+
+	var resp authResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vaultLease{}, fmt.Errorf("failed to unmarshal JSON response: %s", err.Error())
+	}
+	if resp.Auth.ClientToken == "" {
+		return vaultLease{}, errors.New("failed to read token from authentication JSON response")
+	}
+	vc.SetToken(resp.Auth.ClientToken)
+	return resp.lease(), nil
+}
+
+// renewSelf extends the client's token and returns its new lease.
+func (vc VaultClient) renewSelf() (vaultLease, error) {
+	status, body, err := vc.do(vc.newRequest("POST", renewSelfPath, []byte("{}")))
+	if err != nil {
+		return vaultLease{}, err
+	}
+	if status != 200 {
+		return vaultLease{}, NewVaultStatusError(fmt.Sprintf("%s - Response code: %d - %s", renewSelfPath, status, body), status)
+	}
+
+	var resp authResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vaultLease{}, fmt.Errorf("failed to unmarshal %s response: %s", renewSelfPath, err.Error())
+	}
+	return resp.lease(), nil
+}
+
+type lookupSelfResponse struct {
+	Data struct {
+		Renewable bool `json:"renewable"`
+		TTL       int  `json:"ttl"`
+	} `json:"data"`
+}
+
+// lookupSelf returns the remaining lease of a token the fetcher was given
+// rather than logged in for.
+func (vc VaultClient) lookupSelf() (vaultLease, error) {
+	status, body, err := vc.do(vc.newRequest("GET", lookupSelfPath, nil))
+	if err != nil {
+		return vaultLease{}, err
+	}
+	if status != 200 {
+		return vaultLease{}, NewVaultStatusError(fmt.Sprintf("%s - Response code: %d - %s", lookupSelfPath, status, body), status)
+	}
+
+	var resp lookupSelfResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vaultLease{}, fmt.Errorf("failed to unmarshal %s response: %s", lookupSelfPath, err.Error())
+	}
+	return vaultLease{Renewable: resp.Data.Renewable, Duration: time.Duration(resp.Data.TTL) * time.Second}, nil
+}
+
+// shouldRevokeToken reports whether the token is revoked once the secrets are
+// fetched. By default only a token the fetcher logged in for is revoked; one
+// passed in with VAULT_TOKEN may still be used by someone else.
+func shouldRevokeToken(minted bool) bool {
+	value := GetenvSafe(secretFetcherRevokeToken, false)
+	switch strings.ToLower(value) {
+	case "":
+		return minted
+	case "true", "1", "yes":
+		return true
+	case "false", "0", "no":
+		return false
+	default:
+		log.Fatalf("ERROR: %s must be true or false, got '%s'", secretFetcherRevokeToken, value)
+		return false
+	}
+}
+
+// revokeSelf revokes the client's token along with its child tokens and
+// leases. The entrypoint waits on it, so it makes a single attempt on the
+// current node, without failing over, that gives up after revokeTimeout.
+func (vc VaultClient) revokeSelf() error {
+	once := vc
+	once.client = vc.client.withoutRetries().withTimeout(revokeTimeout)
+
+	req := vc.newRequest("POST", revokeSelfPath, nil)
+	req.URL = nodeURL(vc.nodes.address(), req.URL)
+	status, body, err := once.send(req)
+	if err != nil {
+		return err
+	}
+	if status != 200 && status != 204 {
+		return fmt.Errorf("%s - Response code: %d - %s", revokeSelfPath, status, body)
+	}
+	return nil
+}
+
+// RevokeToken revokes the token the secrets were fetched with. Failing to do
+// so is only logged: the token expires with its TTL anyway.
+func RevokeToken() {
+	client := NewVaultClient()
+	if err := client.revokeSelf(); err != nil {
+		log.Printf("WARN: failed to revoke the Vault token, it stays valid until it expires: %s", err.Error())
+		return
+	}
+	log.Println("INFO: revoked the Vault token")
+}
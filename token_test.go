@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRevokeSelfDoesNotWaitForVault(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+	var otherRequests int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherRequests, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer other.Close()
+
+	previous := revokeTimeout
+	revokeTimeout = 100 * time.Millisecond
+	defer func() { revokeTimeout = previous }()
+
+	vc := VaultClient{
+		nodes:  newVaultNodes(hanging.URL+","+other.URL, http.DefaultClient),
+		client: newRetryClient(http.DefaultClient, retryPolicy{maxRetries: 4, timeout: time.Minute}),
+		token:  &vaultToken{value: "t1"},
+	}
+
+	start := time.Now()
+	err := vc.revokeSelf()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("revokeSelf() took %s against a Vault that doesn't answer, want it to give up after %s", elapsed, revokeTimeout)
+	}
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("revokeSelf() error = %v, want a timeout", err)
+	}
+	if n := atomic.LoadInt32(&otherRequests); n != 0 {
+		t.Errorf("revokeSelf() failed over to another node (%d request(s)), want a single attempt", n)
+	}
+}
+
+func TestRevokeSelf(t *testing.T) {
+	var token atomic.Value
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/"+revokeSelfPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		token.Store(r.Header.Get("X-Vault-Token"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vault.Close()
+	vc := newTestVaultClient(vault)
+	vc.SetToken("t1")
+
+	if err := vc.revokeSelf(); err != nil {
+		t.Fatalf("revokeSelf() error = %v", err)
+	}
+	if got, _ := token.Load().(string); got != "t1" {
+		t.Errorf("revoked token %q, want t1", got)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	secretFetcherWatchInterval = "FETCHER_WATCH_INTERVAL"
+	secretFetcherOnChange      = "FETCHER_ON_CHANGE"
+	secretFetcherRestartGrace  = "FETCHER_RESTART_GRACE"
+	defaultRestartGrace        = 30 * time.Second
+	changeActionRestart        = "restart"
+	changeActionNone           = "none"
+)
+
+var changeSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// changeAction is what the watcher does when a secret changes: restart the
+// entrypoint, send it a signal, or nothing.
+type changeAction struct {
+	restart bool
+	signal  syscall.Signal
+}
+
+// parseChangeAction parses `restart`, `none` or a signal name such as
+// `SIGHUP` or `HUP`.
+func parseChangeAction(value string) (changeAction, error) {
+	switch strings.ToLower(value) {
+	case changeActionRestart:
+		return changeAction{restart: true}, nil
+	case changeActionNone:
+		return changeAction{}, nil
+	}
+	if sig, ok := changeSignals[strings.TrimPrefix(strings.ToUpper(value), "SIG")]; ok {
+		return changeAction{signal: sig}, nil
+	}
+	return changeAction{}, fmt.Errorf("'%s' is not restart, none or one of SIGHUP, SIGINT, SIGQUIT, SIGUSR1, SIGUSR2, SIGTERM or SIGWINCH", value)
+}
+
+// watcher polls the paths the secrets were read from and acts on the
+// entrypoint when a secret's value changes.
+type watcher struct {
+	client        *VaultClient
+	secrets       []Secret
+	groups        []*secretGroup
+	actions       []changeAction
+	interval      time.Duration
+	restartGrace  time.Duration
+	supervisor    *supervisor
+	restartMarked bool
+}
+
+// newWatcher returns a watcher for secrets, or nil when watching isn't
+// enabled with FETCHER_WATCH_INTERVAL.
+func newWatcher(secrets []Secret, groups []*secretGroup) *watcher {
+	interval := getenvDuration(secretFetcherWatchInterval, 0)
+	if interval == 0 {
+		return nil
+	}
+
+	defaultAction := changeActionRestart
+	if value := GetenvSafe(secretFetcherOnChange, false); value != "" {
+		defaultAction = value
+	}
+	if _, err := parseChangeAction(defaultAction); err != nil {
+		log.Fatalf("ERROR: invalid %s: %s", secretFetcherOnChange, err.Error())
+	}
+
+	actions := make([]changeAction, len(secrets))
+	for i, secret := range secrets {
+		onChange := secret.GetOnChange()
+		if onChange == "" {
+			onChange = defaultAction
+		}
+		actions[i], _ = parseChangeAction(onChange)
+	}
+
+	// Dynamic secrets differ on every read, and the renewer replaces those
+	// that need it; only the paths read from KV are watched.
+	kvGroups := []*secretGroup{}
+	for _, group := range groups {
+		if isKVGroup(group, secrets) {
+			kvGroups = append(kvGroups, group)
+		}
+	}
+
+	return &watcher{
+		client:       NewVaultClient(),
+		secrets:      secrets,
+		groups:       kvGroups,
+		actions:      actions,
+		interval:     interval,
+		restartGrace: getenvDuration(secretFetcherRestartGrace, defaultRestartGrace),
+	}
+}
+
+// run checks for changes every interval, give or take 10%, until the
+// fetcher exits.
+func (w *watcher) run(s *supervisor) {
+	w.supervisor = s
+	log.Printf("INFO: watching %d path(s) for changes every %s", len(w.groups), w.interval)
+	for {
+		jitter := time.Duration(rand.Int63n(int64(w.interval)/5+1)) - w.interval/10
+		time.Sleep(w.interval + jitter)
+		w.check()
+	}
+}
+
+func (w *watcher) check() {
+	changed := []int{}
+	for _, group := range w.groups {
+		// A pinned version never changes.
+		if group.version > 0 || !w.watched(group) {
+			continue
+		}
+		indices, err := w.checkGroup(group)
+		if err != nil {
+			log.Printf("WARN: failed to check '%s' for changes: %s", group.path, err.Error())
+			continue
+		}
+		changed = append(changed, indices...)
+	}
+	if len(changed) > 0 {
+		w.act(changed)
+	}
+}
+
+// isKVGroup reports whether every secret of group is read from KV.
+func isKVGroup(group *secretGroup, secrets []Secret) bool {
+	if group.params != nil {
+		return false
+	}
+	for _, i := range group.indices {
+		if dynamicOf(secrets[i]) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// watched reports whether a change to any secret of group has an action.
+func (w *watcher) watched(group *secretGroup) bool {
+	for _, i := range group.indices {
+		if w.actions[i] != (changeAction{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGroup reads group's path again when it may have changed and returns
+// the indices of the secrets whose value differs from the last one. On KV v2
+// only the metadata is read until its current version moves on.
+func (w *watcher) checkGroup(group *secretGroup) ([]int, error) {
+	if group.currentVersion > 0 {
+		current, err := w.client.currentVersion(group.vaultNamespace, group.path)
+		if statusErr, ok := err.(VaultStatusError); ok && statusErr.StatusCode == 403 {
+			// Reading metadata takes a policy of its own; without it, fall
+			// back to comparing the data.
+		} else if err != nil {
+			return nil, err
+		} else if current == group.currentVersion {
+			return nil, nil
+		}
+	}
+
+	resp, err := w.client.readSecret(group.vaultNamespace, group.path, 0)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashData(resp.GetData())
+	if hash == group.dataHash {
+		group.currentVersion = resp.GetVersion()
+		return nil, nil
+	}
+	if debugMode {
+		log.Printf("DEBUG: '%s' changed (version %d -> %d)", group.path, group.currentVersion, resp.GetVersion())
+	}
+	group.currentVersion, group.dataHash = resp.GetVersion(), hash
+
+	changed := []int{}
+	for _, i := range group.indices {
+		secret := w.secrets[i]
+		previous := secret.GetValue()
+		if err := extractSecret(resp, secret); err != nil {
+			log.Printf("WARN: %s can't be read from the new version of '%s': %s", secret.VarName(), group.path, err.Error())
+			continue
+		}
+		if secret.GetValue() != previous {
+			changed = append(changed, i)
+		}
+	}
+	return changed, nil
+}
+
+// act restarts the entrypoint when any of the changed secrets asks for it,
+// and otherwise sends it each distinct signal they ask for.
+func (w *watcher) act(changed []int) {
+	names := []string{}
+	restart := false
+	signals := map[syscall.Signal]bool{}
+	for _, i := range changed {
+		names = append(names, w.secrets[i].VarName())
+		if w.actions[i].restart {
+			restart = true
+		} else if w.actions[i].signal != 0 {
+			signals[w.actions[i].signal] = true
+		}
+	}
+
+	if restart {
+		if w.restartMarked {
+			return
+		}
+		w.restartMarked = true
+		log.Printf("INFO: %s changed in Vault, stopping the entrypoint so it restarts with the new values", strings.Join(names, ", "))
+		w.supervisor.stop(w.restartGrace)
+		return
+	}
+	for sig := range signals {
+		log.Printf("INFO: %s changed in Vault, sending %s to the entrypoint", strings.Join(names, ", "), sig)
+		if err := w.supervisor.signal(sig); err != nil {
+			log.Printf("WARN: failed to send %s to the entrypoint: %s", sig, err.Error())
+		}
+	}
+}
+
+type metadataResponse struct {
+	Data struct {
+		CurrentVersion int `json:"current_version"`
+	} `json:"data"`
+}
+
+// currentVersion reads the current version of a KV v2 secret from its
+// metadata.
+func (vc VaultClient) currentVersion(namespace, secretPath string) (int, error) {
+	mount, err := vc.lookupMount(namespace, secretPath)
+	if err != nil {
+		return 0, err
+	}
+	if !mount.isKVv2() {
+		return 0, fmt.Errorf("'%s' is not on a KV v2 mount", secretPath)
+	}
+
+	req := vc.newReadSecretRequest(mount.metadataPath(secretPath))
+	vc.setNamespace(req, namespace)
+	status, body, err := vc.do(req)
+	if err != nil {
+		return 0, err
+	}
+	if status != 200 {
+		return 0, NewVaultStatusError(fmt.Sprintf("failed to read the metadata of '%s' - Response code: %d", secretPath, status), status)
+	}
+
+	var resp metadataResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal the metadata of '%s': %s", secretPath, err.Error())
+	}
+	return resp.Data.CurrentVersion, nil
+}
+
+// hashData returns a digest of a secret's data, to notice changes without
+// keeping a copy of it.
+func hashData(data VaultV1Data) string {
+	// Maps are encoded with sorted keys, so equal data hashes the same.
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeKVv2 serves a single KV v2 secret at `kv/app`, whose data and version
+// can be changed between polls, and counts the reads of its data.
+type fakeKVv2 struct {
+	sync.Mutex
+	version   int
+	data      map[string]string
+	dataReads int
+}
+
+func (f *fakeKVv2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/"+mountLookupPath):
+		fmt.Fprint(w, `{"data":{"path":"kv/","type":"kv","options":{"version":"2"}}}`)
+	case r.URL.Path == "/v1/kv/metadata/app":
+		fmt.Fprintf(w, `{"data":{"current_version":%d}}`, f.version)
+	case r.URL.Path == "/v1/kv/data/app":
+		f.dataReads++
+		data, _ := json.Marshal(f.data)
+		fmt.Fprintf(w, `{"data":{"data":%s,"metadata":{"version":%d}}}`, data, f.version)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeKVv2) write(data map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	f.version++
+	f.data = data
+}
+
+func (f *fakeKVv2) reads() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.dataReads
+}
+
+func TestWatcherCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		onChange   string
+		newData    map[string]string
+		wantSignal syscall.Signal
+		wantValue  string
+	}{
+		{
+			name:       "restart",
+			onChange:   "restart",
+			newData:    map[string]string{"password": "new", "user": "app"},
+			wantSignal: syscall.SIGTERM,
+			wantValue:  "new",
+		},
+		{
+			name:       "signal",
+			onChange:   "SIGUSR1",
+			newData:    map[string]string{"password": "new", "user": "app"},
+			wantSignal: syscall.SIGUSR1,
+			wantValue:  "new",
+		},
+		{
+			name:      "none",
+			onChange:  "none",
+			newData:   map[string]string{"password": "new", "user": "app"},
+			wantValue: "old",
+		},
+		{
+			name:      "another key changed",
+			onChange:  "restart",
+			newData:   map[string]string{"password": "old", "user": "admin"},
+			wantValue: "old",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := &fakeKVv2{version: 1, data: map[string]string{"password": "old", "user": "app"}}
+			server := httptest.NewServer(vault)
+			defer server.Close()
+			vc := newTestVaultClient(server)
+
+			secret, err := newV2Secret("DB_PASSWORD", []byte(`{"path":"kv/app","key":"password","on_change":"`+tt.onChange+`"}`))
+			if err != nil {
+				t.Fatalf("newV2Secret() error = %v", err)
+			}
+			secrets := []Secret{secret}
+			groups := groupSecrets(secrets)
+			errs := make([]error, len(secrets))
+			fetchGroup(&vc, groups[0], secrets, errs)
+			if errs[0] != nil {
+				t.Fatalf("fetchGroup() error = %v", errs[0])
+			}
+			action, _ := parseChangeAction(tt.onChange)
+
+			entrypoint := exec.Command("sleep", "30")
+			if err := entrypoint.Start(); err != nil {
+				t.Fatalf("failed to start the entrypoint: %s", err)
+			}
+			defer entrypoint.Process.Kill()
+			exited := make(chan *exec.ExitError, 1)
+			go func() {
+				err := entrypoint.Wait()
+				exitErr, _ := err.(*exec.ExitError)
+				exited <- exitErr
+			}()
+
+			w := &watcher{
+				client:       &vc,
+				secrets:      secrets,
+				groups:       groups,
+				actions:      []changeAction{action},
+				restartGrace: time.Minute,
+				supervisor:   &supervisor{cmd: entrypoint},
+			}
+
+			w.check()
+			if got := vault.reads(); got != 1 {
+				t.Errorf("unchanged version read the data %d more time(s), want only the metadata", got-1)
+			}
+
+			vault.write(tt.newData)
+			w.check()
+			if secret.GetValue() != tt.wantValue {
+				t.Errorf("value = %q after the change, want %q", secret.GetValue(), tt.wantValue)
+			}
+
+			select {
+			case exitErr := <-exited:
+				if tt.wantSignal == 0 {
+					t.Fatalf("entrypoint exited (%v), want it left running", exitErr)
+				}
+				if exitErr == nil {
+					t.Fatalf("entrypoint exited normally, want it to get %s", tt.wantSignal)
+				}
+				status := exitErr.Sys().(syscall.WaitStatus)
+				if !status.Signaled() || status.Signal() != tt.wantSignal {
+					t.Errorf("entrypoint ended with %v, want %s", exitErr, tt.wantSignal)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantSignal != 0 {
+					t.Fatalf("entrypoint didn't get %s", tt.wantSignal)
+				}
+			}
+		})
+	}
+}
+
+func TestParseChangeAction(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    changeAction
+		wantErr bool
+	}{
+		{value: "restart", want: changeAction{restart: true}},
+		{value: "none", want: changeAction{}},
+		{value: "SIGHUP", want: changeAction{signal: syscall.SIGHUP}},
+		{value: "usr2", want: changeAction{signal: syscall.SIGUSR2}},
+		{value: "SIGKILL", wantErr: true},
+		{value: "reload", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseChangeAction(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChangeAction(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseChangeAction(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}